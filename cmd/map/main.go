@@ -4,13 +4,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"image"
 	"image/color"
 	"image/draw"
 	"log"
+	"strings"
 	"sync"
 
+	"github.com/ktye/map/orux"
 	"github.com/ktye/map/tile"
 	"golang.org/x/exp/shiny/driver"
 	"golang.org/x/exp/shiny/screen"
@@ -19,26 +22,35 @@ import (
 	"golang.org/x/mobile/event/mouse"
 	"golang.org/x/mobile/event/paint"
 	"golang.org/x/mobile/event/size"
+	_ "modernc.org/sqlite"
 )
 
 var (
 	generation int
 
-	tileSize   = image.Point{256, 256}
-	tileBounds = image.Rectangle{Max: tileSize}
+	tileSize   image.Point // set from the tile server
+	tileBounds image.Rectangle
 )
 
 var Origin = image.Point{}
 var Zoom int
 var tileServer tile.Server
+var tileCache *tile.CacheServer
 
 func main() {
 	// Process command line arguments.
-	var cache int
-	var local, url, points string
+	var cache, cachemb, tilesize, quality int
+	var local, format, url, subdomains, oruxdir, points string
 	flag.IntVar(&cache, "cache", 10000, "max number of cached files, set to -1 to disable completely")
-	flag.StringVar(&local, "local", "", "directory of local file server, disabled by default")
-	flag.StringVar(&url, "url", "", "URL of a http tile server")
+	flag.IntVar(&cachemb, "cachemb", 256, "memory budget in MB for a cache of png encoded tiles, set to 0 to cache decoded tiles limited by -cache")
+	flag.StringVar(&local, "local", "", "directory of local file server or an .mbtiles file, disabled by default")
+	flag.StringVar(&format, "format", "png", "image format of new tiles in the local directory: png or jpeg")
+	flag.IntVar(&quality, "quality", 0, "jpeg quality [1..100] of the local directory, 0 for the default")
+	flag.StringVar(&url, "url", "", "URL of a http tile server, or a template such as https://{s}.tile.example.com/{z}/{x}/{y}.png")
+	flag.StringVar(&subdomains, "subdomains", "a,b,c", "comma separated subdomains for {s} in a url template")
+	flag.StringVar(&oruxdir, "orux", "", "directory of an OruxMaps map to show instead of a url")
+	flag.IntVar(&tilesize, "size", 0, "tile size in pixels of a url template server, e.g. 512 for @2x tiles")
+	flag.StringVar(&tile.DefaultClient.UserAgent, "agent", tile.DefaultClient.UserAgent, "User-Agent header for http requests")
 	flag.IntVar(&Zoom, "zoom", 0, "zoom level [0..24]")
 	flag.StringVar(&points, "points", "points.dat", "file name of points file")
 	flag.Parse()
@@ -48,28 +60,75 @@ func main() {
 	}
 
 	// Start the tile server.
-	if url == "" && local == "" {
+	if url == "" && local == "" && oruxdir == "" {
 		tileServer = tile.Mandelbrot{}
 	} else {
-		tileServer = tile.CombinedServer{
-			Points: tile.NewPointServer(points, color.RGBA{0, 255, 0, 255}),
-			Cache:  tile.NewCacheServer(cache),
-			Local:  tile.LocalServer(local),
-			Http:   tile.HttpServer(url),
+		if cachemb > 0 && cache >= 0 {
+			tileCache = tile.NewEncodedCacheServer(int64(cachemb) << 20)
+		} else {
+			tileCache = tile.NewCacheServer(cache)
+		}
+		var remote tile.Server
+		if strings.Contains(url, "{") {
+			t := tile.NewTemplateServer(url, strings.Split(subdomains, ",")...)
+			t.Size = tilesize
+			remote = t
+		} else if url != "" {
+			remote = tile.HttpServer(url)
+		}
+		if oruxdir != "" {
+			r, err := orux.Open(oruxdir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer r.Close()
+			remote = r
+		}
+		var store tile.Store
+		if strings.HasSuffix(local, ".mbtiles") {
+			// Without a remote server, the file is only read and must exist.
+			open := tile.OpenMBTiles
+			if remote == nil {
+				open = tile.OpenMBTilesReadOnly
+			}
+			m, err := open(local)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer m.Close()
+			if m.Format == "" {
+				m.Format = tile.Format(format)
+			}
+			m.Quality = quality
+			store = m
+		} else if local != "" {
+			store = tile.FileServer{Dir: local, Format: tile.Format(format), Quality: quality}
 		}
+		tileServer = tile.NewSingleFlight(tile.CombinedServer{
+			Points: tile.NewPointServer(points, color.RGBA{0, 255, 0, 255}),
+			Cache:  tileCache,
+			Store:  store,
+			Remote: remote,
+		})
 	}
 
+	n := tile.SizeOf(tileServer)
+	tileSize = image.Point{n, n}
+	tileBounds = image.Rectangle{Max: tileSize}
+
 	driver.Main(func(s screen.Screen) {
 		w, err := s.NewWindow(nil)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer w.Release()
+		defer logCacheStats()
 
 		var (
 			pool = &tilePool{
 				screen:   s,
 				drawRGBA: drawRGBA,
+				redraw:   func() { w.Send(paint.Event{}) },
 				m:        map[image.Point]*tilePoolEntry{},
 			}
 			dragging     bool
@@ -137,14 +196,11 @@ func main() {
 
 			case paint.Event:
 				generation++
-				var wg sync.WaitGroup
-				for y := -(Origin.Y & 0xff); y < sz.HeightPx; y += 256 {
-					for x := -(Origin.X & 0xff); x < sz.WidthPx; x += 256 {
-						wg.Add(1)
-						go drawTile(&wg, w, pool, Origin, x, y)
+				for y := -mod(Origin.Y, tileSize.Y); y < sz.HeightPx; y += tileSize.Y {
+					for x := -mod(Origin.X, tileSize.X); x < sz.WidthPx; x += tileSize.X {
+						drawTile(w, pool, Origin, x, y)
 					}
 				}
-				wg.Wait()
 				w.Publish()
 				paintPending = false
 				pool.releaseUnused()
@@ -159,53 +215,108 @@ func main() {
 	})
 }
 
-func drawTile(wg *sync.WaitGroup, w screen.Window, pool *tilePool, Origin image.Point, x, y int) {
-	defer wg.Done()
+func logCacheStats() {
+	if tileCache != nil {
+		s := tileCache.Stats()
+		log.Printf("cache: %d tiles (%d MB), %d hits, %d misses, %d evictions", s.Tiles, s.Bytes>>20, s.Hits, s.Misses, s.Evictions)
+	}
+}
+
+// drawTile copies the tile at window position x, y, if it is loaded already.
+// Otherwise it fills the area white and the tile is drawn with a later paint event.
+func drawTile(w screen.Window, pool *tilePool, Origin image.Point, x, y int) {
 	tp := image.Point{
-		(x + Origin.X) >> 8,
-		(y + Origin.Y) >> 8,
+		div(x+Origin.X, tileSize.X),
+		div(y+Origin.Y, tileSize.Y),
 	}
-	tex, err := pool.get(tp)
-	if err != nil {
-		log.Println(err)
-		return
+	dp := image.Point{x, y}
+	if tex := pool.get(tp); tex != nil {
+		w.Copy(dp, tex, tileBounds, screen.Src, nil)
+	} else {
+		w.Fill(tileBounds.Add(dp), color.White, screen.Src)
 	}
-	w.Copy(image.Point{x, y}, tex, tileBounds, screen.Src, nil)
 }
 
-func drawRGBA(m *image.RGBA, tp image.Point) {
-	srcImg, err := tileServer.Get(Zoom, tp.X, tp.Y)
-	if err != nil {
+// div and mod round towards negative infinity, as the Origin may be negative after zooming out.
+func div(a, n int) int { return (a - mod(a, n)) / n }
+func mod(a, n int) int { return ((a % n) + n) % n }
+
+func drawRGBA(ctx context.Context, m *image.RGBA, z int, tp image.Point) error {
+	var srcImg image.Image
+	srcImg, err := tile.WithContext(tileServer).GetContext(ctx, z, tp.X, tp.Y)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
 		log.Print(err)
 		srcImg = image.White
 	}
 	draw.Draw(m, m.Bounds(), srcImg, image.Point{}, draw.Src)
+	return nil
 }
 
+// tilePoolEntry is a texture in the pool.
+// While the tile is loaded, tex is nil and cancel aborts the request.
 type tilePoolEntry struct {
-	tex screen.Texture
-	gen int
+	tex    screen.Texture
+	gen    int
+	cancel context.CancelFunc
 }
 
 type tilePool struct {
 	screen   screen.Screen
-	drawRGBA func(*image.RGBA, image.Point)
+	drawRGBA func(context.Context, *image.RGBA, int, image.Point) error
+	redraw   func()
 
 	mu sync.Mutex
 	m  map[image.Point]*tilePoolEntry
 }
 
-func (p *tilePool) get(tp image.Point) (screen.Texture, error) {
+// get returns the texture for the tile at tp.
+// If it is not available, it starts loading it in the background and returns nil.
+func (p *tilePool) get(tp image.Point) screen.Texture {
 	p.mu.Lock()
-	v, ok := p.m[tp]
-	if v != nil {
+	defer p.mu.Unlock()
+
+	if v, ok := p.m[tp]; ok {
 		v.gen = generation
+		return v.tex
 	}
-	p.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	v := &tilePoolEntry{
+		gen:    generation,
+		cancel: cancel,
+	}
+	p.m[tp] = v
+	go p.load(ctx, v, Zoom, tp)
+	return nil
+}
+
+// load creates the texture for the pool entry v and requests a repaint.
+// The result is dropped, if the entry has been released in the meantime.
+func (p *tilePool) load(ctx context.Context, v *tilePoolEntry, z int, tp image.Point) {
+	tex, err := p.newTexture(ctx, z, tp)
 
-	if ok {
-		return v.tex, nil
+	p.mu.Lock()
+	if p.m[tp] != v {
+		p.mu.Unlock()
+		if tex != nil {
+			tex.Release()
+		}
+		return
+	}
+	if err != nil {
+		delete(p.m, tp)
+		p.mu.Unlock()
+		log.Print(err)
+		return
 	}
+	v.tex = tex
+	p.mu.Unlock()
+
+	p.redraw()
+}
+
+func (p *tilePool) newTexture(ctx context.Context, z int, tp image.Point) (screen.Texture, error) {
 	tex, err := p.screen.NewTexture(tileSize)
 	if err != nil {
 		return nil, err
@@ -215,17 +326,12 @@ func (p *tilePool) get(tp image.Point) (screen.Texture, error) {
 		tex.Release()
 		return nil, err
 	}
-	p.drawRGBA(buf.RGBA(), tp)
-	tex.Upload(image.Point{}, buf, tileBounds)
-	buf.Release()
-
-	p.mu.Lock()
-	p.m[tp] = &tilePoolEntry{
-		tex: tex,
-		gen: generation,
+	defer buf.Release()
+	if err := p.drawRGBA(ctx, buf.RGBA(), z, tp); err != nil {
+		tex.Release()
+		return nil, err
 	}
-	p.mu.Unlock()
-
+	tex.Upload(image.Point{}, buf, tileBounds)
 	return tex, nil
 }
 
@@ -247,7 +353,10 @@ func (p *tilePool) releaseUnused() {
 		if v.gen == generation {
 			continue
 		}
-		v.tex.Release()
+		v.cancel()
+		if v.tex != nil {
+			v.tex.Release()
+		}
 		delete(p.m, tp)
 	}
 }
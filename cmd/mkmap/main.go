@@ -0,0 +1,248 @@
+// Mkmap builds offline maps from a tile source.
+//
+// The map area is given as a bounding box or a city from tile.Cities.
+// Tiles are requested from a url template, a local directory or an MBTiles file,
+// and written as an OruxMaps map, an MBTiles or RMaps sqlite file, or a tile directory.
+//
+// Example:
+//
+//	mkmap -city hamburg -radius 5 -zoom 10-14 -url 'https://tile.example.com/{z}/{x}/{y}.png' -out hamburg
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ktye/map/orux"
+	"github.com/ktye/map/tile"
+	_ "modernc.org/sqlite"
+)
+
+// estimatedTileBytes is the average size of a png tile with 256x256 pixels used for the dry run.
+const estimatedTileBytes = 15 << 10
+
+func main() {
+	var bbox, city, zoom, url, subdomains, dir, mbtiles, format, out string
+	var radius float64
+	var size, concurrency int
+	var failfast, dryrun bool
+	flag.StringVar(&bbox, "bbox", "", "map area as top left and bottom right corner: lat,lon,lat,lon (degree)")
+	flag.StringVar(&city, "city", "", "map area around a city from tile.Cities")
+	flag.Float64Var(&radius, "radius", 10, "distance from the city center to the edge of the map (km)")
+	flag.StringVar(&zoom, "zoom", "", "zoom levels, e.g. 12,14 or 10-15")
+	flag.StringVar(&url, "url", "", "tile source: URL of a http tile server, or a template such as https://{s}.tile.example.com/{z}/{x}/{y}.png")
+	flag.StringVar(&subdomains, "subdomains", "a,b,c", "comma separated subdomains for {s} in a url template")
+	flag.IntVar(&size, "size", 0, "tile size in pixels of a url template server, e.g. 512 for @2x tiles")
+	flag.StringVar(&tile.DefaultClient.UserAgent, "agent", tile.DefaultClient.UserAgent, "User-Agent header for http requests")
+	flag.StringVar(&dir, "dir", "", "tile source: local tile directory z/x/y, it caches tiles from -url")
+	flag.StringVar(&mbtiles, "mbtiles", "", "tile source: MBTiles file, it caches tiles from -url")
+	flag.StringVar(&format, "format", "orux", "output format: orux, mbtiles, rmaps or dir")
+	flag.StringVar(&out, "out", "", "output directory (orux, dir) or file name (mbtiles, rmaps)")
+	flag.IntVar(&concurrency, "concurrency", 2, "number of tiles requested in parallel")
+	flag.BoolVar(&failfast, "failfast", false, "stop at the first tile, that fails")
+	flag.BoolVar(&dryrun, "dryrun", false, "print the number of tiles and the estimated size and exit")
+	flag.Parse()
+
+	m := orux.Map{Concurrency: concurrency, FailFast: failfast}
+	var err error
+	if m.TopLeft, m.BottomRight, err = area(bbox, city, radius); err != nil {
+		log.Fatal(err)
+	}
+	if m.ZoomLevels, err = zoomLevels(zoom); err != nil {
+		log.Fatal(err)
+	}
+
+	if dryrun {
+		counts, err := m.Count()
+		if err != nil {
+			log.Fatal(err)
+		}
+		tilesize := size
+		if tilesize == 0 {
+			tilesize = tile.TileSize
+		}
+		n := 0
+		for _, z := range m.ZoomLevels {
+			fmt.Printf("zoom %2d: %d tiles\n", z, counts[z])
+			n += counts[z]
+		}
+		bytes := float64(n) * estimatedTileBytes * float64(tilesize*tilesize) / float64(tile.TileSize*tile.TileSize)
+		fmt.Printf("total: %d tiles, estimated size %.1f MB\n", n, bytes/(1<<20))
+		return
+	}
+
+	if out == "" {
+		log.Fatal("-out is missing")
+	}
+	src, closer, err := source(url, subdomains, size, dir, mbtiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closer()
+
+	// Each zoom level gets a progress line. The total is unknown for a sparse source.
+	level := -1
+	m.Progress = func(p orux.Progress) {
+		if level >= 0 && p.Zoom != level {
+			fmt.Fprintln(os.Stderr)
+		}
+		level = p.Zoom
+		if p.Total == 0 {
+			fmt.Fprintf(os.Stderr, "\rzoom %2d: %d", p.Zoom, p.Done)
+		} else {
+			fmt.Fprintf(os.Stderr, "\rzoom %2d: %d/%d", p.Zoom, p.Done, p.Total)
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	switch format {
+	case "orux":
+		err = m.EncodeContext(ctx, out, src)
+	case "mbtiles":
+		err = m.EncodeMBTilesContext(ctx, out, src)
+	case "rmaps":
+		err = m.EncodeRMapsContext(ctx, out, src)
+	case "dir":
+		err = m.CopyContext(ctx, tile.FileServer{Dir: out}, src)
+	default:
+		err = fmt.Errorf("unknown output format: %s", format)
+	}
+	if level >= 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		closer()
+		log.Fatal(err)
+	}
+}
+
+// area returns the corners of the map from the bounding box or the city.
+func area(bbox, city string, radius float64) (tl, br tile.LatLon, err error) {
+	if bbox != "" && city != "" {
+		return tl, br, fmt.Errorf("-bbox and -city cannot be used together")
+	}
+	if city != "" {
+		c, ok := tile.Cities[strings.ToLower(city)]
+		if !ok {
+			return tl, br, fmt.Errorf("unknown city: %s", city)
+		}
+		b := tile.BBoxOf(c).Expand(tile.Meter(radius * 1000))
+		return b.TopLeft(), b.BottomRight(), nil
+	}
+	if bbox == "" {
+		return tl, br, fmt.Errorf("map area is missing: use -bbox or -city")
+	}
+	v := strings.Split(bbox, ",")
+	if len(v) != 4 {
+		return tl, br, fmt.Errorf("-bbox must have 4 values: lat,lon,lat,lon")
+	}
+	var f [4]float64
+	for i := range v {
+		if f[i], err = strconv.ParseFloat(strings.TrimSpace(v[i]), 64); err != nil {
+			return tl, br, fmt.Errorf("-bbox: %s", err)
+		}
+	}
+	return tile.LatLon{tile.Degree(f[0]), tile.Degree(f[1])}, tile.LatLon{tile.Degree(f[2]), tile.Degree(f[3])}, nil
+}
+
+// zoomLevels parses a list of zoom levels or ranges, e.g. 8,10-12.
+func zoomLevels(s string) ([]int, error) {
+	if s == "" {
+		return nil, fmt.Errorf("-zoom is missing")
+	}
+	var zoom []int
+	for _, v := range strings.Split(s, ",") {
+		a, b, ok := strings.Cut(v, "-")
+		if !ok {
+			b = a
+		}
+		z0, err := strconv.Atoi(strings.TrimSpace(a))
+		if err != nil {
+			return nil, fmt.Errorf("-zoom: %s", err)
+		}
+		z1, err := strconv.Atoi(strings.TrimSpace(b))
+		if err != nil {
+			return nil, fmt.Errorf("-zoom: %s", err)
+		}
+		for z := z0; z <= z1; z++ {
+			zoom = append(zoom, z)
+		}
+	}
+	slices.Sort(zoom)
+	return slices.Compact(zoom), nil
+}
+
+// source returns the tile server for the command line arguments.
+// The returned function closes an MBTiles file.
+func source(url, subdomains string, size int, dir, mbtiles string) (tile.Server, func(), error) {
+	closer := func() {}
+	var remote tile.Server
+	if strings.Contains(url, "{") {
+		t := tile.NewTemplateServer(url, strings.Split(subdomains, ",")...)
+		t.Size = size
+		remote = t
+	} else if url != "" {
+		remote = tile.HttpServer(url)
+	}
+
+	var local tile.Store
+	if dir != "" && mbtiles != "" {
+		return nil, closer, fmt.Errorf("-dir and -mbtiles cannot be used together")
+	} else if dir != "" {
+		local = tile.FileServer{Dir: dir}
+	} else if mbtiles != "" {
+		// Without -url, the file is only read and must exist.
+		open := tile.OpenMBTiles
+		if remote == nil {
+			open = tile.OpenMBTilesReadOnly
+		}
+		m, err := open(mbtiles)
+		if err != nil {
+			return nil, closer, err
+		}
+		local, closer = m, func() { m.Close() }
+	}
+
+	switch {
+	case local != nil && remote != nil:
+		return cachedServer{local: local, remote: remote}, closer, nil
+	case local != nil:
+		return local, closer, nil
+	case remote != nil:
+		return remote, closer, nil
+	}
+	return nil, closer, fmt.Errorf("tile source is missing: use -url, -dir or -mbtiles")
+}
+
+// cachedServer requests missing tiles of the local store from the remote server and adds them.
+// In contrast to tile.CombinedServer, it returns errors instead of black tiles.
+type cachedServer struct {
+	local  tile.Store
+	remote tile.Server
+}
+
+func (c cachedServer) Get(z, x, y int) (tile.Tile, error) {
+	return c.GetContext(context.Background(), z, x, y)
+}
+
+func (c cachedServer) GetContext(ctx context.Context, z, x, y int) (tile.Tile, error) {
+	if t, err := tile.WithContext(c.local).GetContext(ctx, z, x, y); err == nil {
+		return t, nil
+	}
+	t, err := tile.WithContext(c.remote).GetContext(ctx, z, x, y)
+	if err != nil {
+		return nil, err
+	}
+	return t, c.local.Add(z, x, y, t)
+}
+
+func (c cachedServer) TileSize() int {
+	return tile.SizeOf(c.remote)
+}
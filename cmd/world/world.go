@@ -92,7 +92,7 @@ func (w *world) addPoint(xy tile.XY) error {
 			}
 		}
 		if t, err := w.Server.Get(w.Zoom, xy.X, xy.Y); err != nil {
-			im := image.NewRGBA(image.Rect(0, 0, 256, 256))
+			im := image.NewRGBA(image.Rect(0, 0, tile.TileSize, tile.TileSize))
 			w.current = im
 		} else {
 			w.current = t
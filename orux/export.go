@@ -0,0 +1,150 @@
+package orux
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ktye/map/tile"
+)
+
+// EncodeRMaps writes the map to a single RMaps sqlite file, which is read by Locus Map and OsmAnd.
+// The region, zoom levels and error handling are the same as for Encode.
+// Tiles are stored with absolute tile numbers and the inverted zoom level 17-z.
+// The file must not exist. It is removed, if the map cannot be written.
+func (m Map) EncodeRMaps(file string, ts tile.Server) error {
+	return m.EncodeRMapsContext(context.Background(), file, ts)
+}
+
+// EncodeRMapsContext is EncodeRMaps with a context.
+func (m Map) EncodeRMapsContext(ctx context.Context, file string, ts tile.Server) error {
+	m = m.bounds()
+	zmin, zmax := zoomRange(m.ZoomLevels)
+	rmaps := dbFormat{
+		prepare: func(ctx context.Context, tx *sql.Tx) error {
+			return execAll(ctx, tx,
+				`CREATE TABLE tiles (x int, y int, z int, s int, image blob, PRIMARY KEY (x,y,z,s))`,
+				`CREATE INDEX IND on tiles (x,y,z,s)`,
+				`CREATE TABLE info (maxzoom Int, minzoom Int)`,
+				fmt.Sprintf(`INSERT INTO info (maxzoom, minzoom) VALUES (%d, %d)`, 17-zmin, 17-zmax),
+				`CREATE TABLE android_metadata (locale TEXT)`,
+				`INSERT INTO android_metadata VALUES ('en_US')`,
+			)
+		},
+		insert: `INSERT OR REPLACE INTO tiles (x, y, z, s, image) VALUES (?, ?, ?, 0, ?)`,
+		args: func(z, x, y int, b []byte) []any {
+			return []any{x, y, 17 - z, b}
+		},
+	}
+	return m.encodeFile(ctx, file, ts, rmaps, nil)
+}
+
+// EncodeMBTiles writes the map to an MBTiles file with png tiles.
+// The region, zoom levels and error handling are the same as for Encode.
+// The metadata contains the bounds and the zoom range of the map,
+// the name is the file name without the extension.
+// The file must not exist. It is removed, if the map cannot be written.
+func (m Map) EncodeMBTiles(file string, ts tile.Server) error {
+	return m.EncodeMBTilesContext(context.Background(), file, ts)
+}
+
+// EncodeMBTilesContext is EncodeMBTiles with a context.
+func (m Map) EncodeMBTilesContext(ctx context.Context, file string, ts tile.Server) error {
+	m = m.bounds()
+	zmin, zmax := zoomRange(m.ZoomLevels)
+	create := func() error {
+		mb, err := tile.OpenMBTiles(file)
+		if err != nil {
+			return err
+		}
+		defer mb.Close()
+		return mb.SetMetadata(tile.MBTilesMetadata{
+			Name:    strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+			Format:  "png",
+			Bounds:  [4]float64{float64(m.TopLeft.Lon), float64(m.BottomRight.Lat), float64(m.BottomRight.Lon), float64(m.TopLeft.Lat)},
+			MinZoom: zmin,
+			MaxZoom: zmax,
+			Other:   map[string]string{"type": "baselayer"},
+		})
+	}
+	mbtiles := dbFormat{
+		prepare: func(context.Context, *sql.Tx) error { return nil },
+		insert:  `INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)`,
+		args: func(z, x, y int, b []byte) []any {
+			return []any{z, x, tile.NumTiles(z) - 1 - y, b}
+		},
+	}
+	return m.encodeFile(ctx, file, ts, mbtiles, create)
+}
+
+// encodeFile writes the map to a new database file with the format f.
+// The function create is called before the tiles are written, if it is not nil.
+func (m Map) encodeFile(ctx context.Context, file string, ts tile.Server, f dbFormat, create func() error) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("%s: %w", file, os.ErrExist)
+	}
+	if create != nil {
+		if err := create(); err != nil {
+			os.Remove(file)
+			return err
+		}
+	}
+	failed, err := m.writeDB(ctx, file, ts, f)
+	if err != nil {
+		os.Remove(file)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if len(failed) > 0 {
+		return &EncodeError{Tiles: failed}
+	}
+	return nil
+}
+
+// zoomRange returns the minimal and maximal zoom level.
+func zoomRange(zoom []int) (zmin, zmax int) {
+	for i, z := range zoom {
+		if i == 0 || z < zmin {
+			zmin = z
+		}
+		if i == 0 || z > zmax {
+			zmax = z
+		}
+	}
+	return zmin, zmax
+}
+
+// Copy writes the tiles of the map to a tile.Store, e.g. a tile.FileServer directory.
+// The region, zoom levels and error handling are the same as for Encode.
+func (m Map) Copy(dst tile.Store, ts tile.Server) error {
+	return m.CopyContext(context.Background(), dst, ts)
+}
+
+// CopyContext is Copy with a context.
+func (m Map) CopyContext(ctx context.Context, dst tile.Store, ts tile.Server) error {
+	m = m.bounds()
+	if err := m.validate(); err != nil {
+		return err
+	}
+	failed, err := m.each(ctx, ts, false, func(r encoded) error {
+		return dst.Add(r.z, r.x, r.y, r.t)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if len(failed) > 0 {
+		return &EncodeError{Tiles: failed}
+	}
+	return nil
+}
@@ -1,17 +1,21 @@
 // Package orux encodes raster tiles in a format oruxmaps can read.
+// The same map definition can also be exported as RMaps sqlite (Locus Map, OsmAnd) or MBTiles.
 //
-// It uses the sqlite3 external command to write the database file.
+// The database files are opened with the driver tile.SQLDriver,
+// which the program has to import, e.g. modernc.org/sqlite.
 package orux
 
 import (
 	"bytes"
-	"encoding/hex"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"image/png"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
+	"sync"
 	"text/template"
 
 	"github.com/ktye/map/tile"
@@ -19,80 +23,370 @@ import (
 
 // Map defines the rectangle of the map and the zoom levels to be stored.
 // The rectangle will be extended to the tile boundaries for the lowest ZoomLevel containing From and To.
+// If TopLeft.Lon is larger than BottomRight.Lon, the map crosses the antimeridian (180°).
 type Map struct {
 	TopLeft, BottomRight tile.LatLon
 	ZoomLevels           []int
+
+	// Region restricts the map to the tiles, which intersect the region, if it is not nil.
+	// TopLeft and BottomRight are ignored and replaced by the bounds of the region.
+	Region Region
+
+	TileSize int // Tile edge length in pixels. If 0, Encode uses the size of the tile server.
+
+	// FailFast stops Encode at the first tile, that cannot be retrieved or encoded.
+	// Otherwise failed tiles are skipped, the map is written without them
+	// and Encode returns an *EncodeError listing them.
+	FailFast bool
+
+	// Progress is called after each tile, if it is not nil.
+	Progress func(Progress)
+
+	// Concurrency is the number of tiles, which are retrieved and encoded in parallel.
+	// The tiles are still written in order by a single writer.
+	// Values below 1 mean 1.
+	Concurrency int
+}
+
+// Progress reports the number of tiles written for the current zoom level.
+// Total is 0 for a SparseServer, where the number of tiles is not known in advance.
+type Progress struct {
+	Zoom, Done, Total int
+}
+
+// TileError is the error for a single tile.
+type TileError struct {
+	Z, X, Y int
+	Err     error
+}
+
+func (e TileError) Error() string {
+	return fmt.Sprintf("tile %d/%d/%d: %s", e.Z, e.X, e.Y, e.Err)
+}
+
+func (e TileError) Unwrap() error { return e.Err }
+
+// EncodeError lists the tiles, that have been skipped by Encode.
+type EncodeError struct {
+	Tiles []TileError
+}
+
+func (e *EncodeError) Error() string {
+	if len(e.Tiles) == 1 {
+		return "orux: " + e.Tiles[0].Error()
+	}
+	return fmt.Sprintf("orux: %d tiles failed, first %s", len(e.Tiles), e.Tiles[0].Error())
+}
+
+func (e *EncodeError) Unwrap() []error {
+	errs := make([]error, len(e.Tiles))
+	for i := range e.Tiles {
+		errs[i] = e.Tiles[i]
+	}
+	return errs
 }
 
 // Encode creates a directory with the given Name and writes 2 files to the directory:
 // The index file name.otrk2.xml and the database file OruxMapsImages.db.
 // The image data is retrieved from the Server.
+// If tiles fail and FailFast is not set, the map is written and an *EncodeError is returned.
 func (m Map) Encode(name string, ts tile.Server) error {
+	return m.EncodeContext(context.Background(), name, ts)
+}
+
+// EncodeContext is Encode with a context.
+// If the context is done before all tiles are written, the database transaction
+// is not committed and ctx.Err() is returned.
+// The directory is removed, if the map cannot be written.
+func (m Map) EncodeContext(ctx context.Context, name string, ts tile.Server) error {
+	m = m.bounds()
+	if err := m.validate(); err != nil {
+		return err
+	}
 	if err := os.Mkdir(name, 0744); err != nil {
 		return err
 	}
 
-	// Temporarily write sqlite3 db file.
-	// Or can sqlite3 pipe the database to stdout?
-	dbfile := filepath.Join(name, "OruxMapsImages.db")
-	cmd := exec.Command("sqlite3", dbfile)
-	if wc, err := cmd.StdinPipe(); err != nil {
-		return err
-	} else {
-		go m.sqlitePipe(wc, ts)
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("%s: %s", err, out)
+	// Write ${name}/OruxMapsImages.db
+	failed, err := m.writeDB(ctx, filepath.Join(name, "OruxMapsImages.db"), ts, oruxFormat(m.TopLeft, create))
+	if err != nil {
+		os.RemoveAll(name)
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		return err
 	}
 
 	// Write ${name}/${name}.otrk2.xml
+	if m.TileSize == 0 {
+		m.TileSize = tile.SizeOf(ts)
+	}
 	if err := m.WriteXML(name); err != nil {
+		os.RemoveAll(name)
 		return err
 	}
+	if len(failed) > 0 {
+		return &EncodeError{Tiles: failed}
+	}
 	return nil
 }
 
-// sqlitePipe creates the database file by writing commands to the
-// sqlite3 process on wc.
-func (m Map) sqlitePipe(wc io.WriteCloser, ts tile.Server) {
-	defer wc.Close()
-	wc.Write([]byte(sqlStart))
+// dbFormat defines how tiles are stored in a sqlite database.
+type dbFormat struct {
+	prepare func(context.Context, *sql.Tx) error // creates or modifies the tables
+	insert  string                               // insert statement for the arguments returned by args
+	args    func(z, x, y int, b []byte) []any    // x is normalized to [0, NumTiles(z)-1]
+}
+
+// oruxFormat stores tiles in OruxMapsImages.db relative to the tile at origin.
+func oruxFormat(origin tile.LatLon, prepare func(context.Context, *sql.Tx) error) dbFormat {
+	return dbFormat{
+		prepare: prepare,
+		insert:  sqlInsert,
+		args: func(z, x, y int, b []byte) []any {
+			// Tiles east of the antimeridian continue after the last tile of the origin.
+			o, _ := tile.BBox{Min: origin, Max: origin}.TileRange(z)
+			n := tile.NumTiles(z)
+			return []any{((x-o.X0)%n + n) % n, y - o.Y0, z, b}
+		},
+	}
+}
+
+// writeDB opens the database file, calls f.prepare and inserts all tiles within a single transaction.
+// It returns the tiles, which have been skipped.
+// The transaction is not committed, if ctx is done, the database cannot be written,
+// or a tile fails with FailFast.
+func (m Map) writeDB(ctx context.Context, file string, ts tile.Server, f dbFormat) ([]TileError, error) {
+	db, err := sql.Open(tile.SQLDriver, file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := f.prepare(ctx, tx); err != nil {
+		return nil, err
+	}
+	insert, err := tx.PrepareContext(ctx, f.insert)
+	if err != nil {
+		return nil, err
+	}
+	defer insert.Close()
+
+	failed, err := m.each(ctx, ts, true, func(r encoded) error {
+		_, err := insert.ExecContext(ctx, f.args(r.z, r.x, r.y, r.b)...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return failed, db.Close()
+}
+
+// each retrieves all tiles of the map and calls write for each tile in order.
+// If encodePNG is true, the tiles are png encoded concurrently.
+// It reports the progress and returns the tiles, which have been skipped.
+// An error from write is returned as a TileError.
+func (m Map) each(ctx context.Context, ts tile.Server, encodePNG bool, write func(encoded) error) ([]TileError, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	results := m.encode(ctx, ts, encodePNG)
+	defer func() {
+		// Stop the workers, if the writer returns early, and wait for them.
+		cancel()
+		for range results {
+		}
+	}()
+
+	var failed []TileError
+	var p Progress
+	var totals map[int]int
+	if _, ok := ts.(tile.SparseServer); !ok {
+		totals = m.totals()
+	}
+	for r := range results {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if p.Zoom != r.z || p.Done == 0 {
+			p = Progress{Zoom: r.z, Total: totals[r.z]}
+		}
+		p.Done++
+		if r.err != nil {
+			e := TileError{Z: r.z, X: r.x, Y: r.y, Err: r.err}
+			if m.FailFast {
+				return nil, e
+			}
+			failed = append(failed, e)
+		} else if err := write(r); err != nil {
+			return nil, TileError{Z: r.z, X: r.x, Y: r.y, Err: err}
+		}
+		if m.Progress != nil {
+			m.Progress(p)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return failed, nil
+}
+
+// encoded is a tile, it's png encoding or the error for the tile.
+type encoded struct {
+	z, x, y int
+	t       tile.Tile
+	b       []byte
+	err     error
+}
 
-	var buf bytes.Buffer
-	insertTile := func(z, x, y, x0, y0 int, t tile.Tile) {
-		buf.Reset()
-		png.Encode(&buf, t)
-		fmt.Fprintf(wc, "INSERT INTO \"tiles\" VALUES(%d,%d,%d,X'%s');", x-x0, y-y0, z, hex.EncodeToString(buf.Bytes()))
+// encode retrieves the tiles of the map with Concurrency workers and png encodes them, if encodePNG is true.
+// The results are sent in the order of the tiles, and the channel is closed after the last tile.
+// A SparseServer is iterated sequentially, only the encoding is concurrent.
+func (m Map) encode(ctx context.Context, ts tile.Server, encodePNG bool) <-chan encoded {
+	type job struct {
+		encoded
+		fetch  bool
+		result chan encoded
 	}
+	n := m.Concurrency
+	if n < 1 {
+		n = 1
+	}
+	jobs := make(chan job)
+	queue := make(chan chan encoded, 2*n) // results in the order of the jobs
+	out := make(chan encoded)
 
-	if sparse, ok := ts.(tile.SparseServer); ok {
-		for {
-			z, x, y, t, err := sparse.Next()
-			if err != nil {
-				break
+	// Producer.
+	go func() {
+		defer close(jobs)
+		defer close(queue)
+		send := func(j job) bool {
+			j.result = make(chan encoded, 1)
+			select {
+			case queue <- j.result:
+			case <-ctx.Done():
+				return false
+			}
+			select {
+			case jobs <- j:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if sparse, ok := ts.(tile.SparseServer); ok {
+			for {
+				z, x, y, t, err := sparse.Next()
+				if err != nil {
+					return
+				} else if !m.includes(z, x, y) {
+					continue
+				}
+				if !send(job{encoded: encoded{z: z, x: x, y: y, t: t}}) {
+					return
+				}
 			}
-			tl, _ := m.TopLeft.XY(z)
-			insertTile(z, x, y, tl.X, tl.Y, t)
 		}
-	} else {
 		for _, z := range m.ZoomLevels {
-			tl, _ := m.TopLeft.XY(z)
-			br, _ := m.BottomRight.XY(z)
-			for x := tl.X; x <= br.X; x++ {
-				for y := tl.Y; y <= br.Y; y++ {
-					if t, err := ts.Get(z, x, y); t != nil {
-						insertTile(z, x, y, tl.X, tl.Y, t)
-					} else {
-						fmt.Println(err)
-					}
+			r, _ := m.bbox().TileRange(z)
+			for xy := range r.All() {
+				if m.contains(z, xy.X, xy.Y) && !send(job{encoded: encoded{z: z, x: xy.X, y: xy.Y}, fetch: true}) {
+					return
+				}
+			}
+		}
+	}()
+
+	// Workers.
+	var wg sync.WaitGroup
+	cs := tile.WithContext(ts)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				r := j.encoded
+				if j.fetch {
+					r.t, r.err = cs.GetContext(ctx, r.z, r.x, r.y)
 				}
+				if r.err == nil && r.t == nil {
+					r.err = errors.New("tile server returned no tile")
+				}
+				if r.err == nil && encodePNG {
+					var buf bytes.Buffer
+					r.err = png.Encode(&buf, r.t)
+					r.b = buf.Bytes()
+				}
+				j.result <- r
+			}
+		}()
+	}
+
+	// Reorder.
+	go func() {
+		defer close(out)
+		defer wg.Wait()
+		for c := range queue {
+			select {
+			case r := <-c:
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Count returns the number of tiles for each zoom level of the map.
+func (m Map) Count() (map[int]int, error) {
+	m = m.bounds()
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m.totals(), nil
+}
+
+// totals returns the number of tiles for each zoom level.
+func (m Map) totals() map[int]int {
+	totals := make(map[int]int)
+	for _, z := range m.ZoomLevels {
+		r, _ := m.bbox().TileRange(z)
+		for xy := range r.All() {
+			if m.contains(z, xy.X, xy.Y) {
+				totals[z]++
 			}
 		}
 	}
-	wc.Write([]byte(sqlEnd))
+	return totals
+}
+
+// create creates the tiles table of a new database.
+func create(ctx context.Context, tx *sql.Tx) error {
+	return execAll(ctx, tx, sqlCreate, sqlIndex)
+}
+
+// execAll executes the statements within the transaction.
+func execAll(ctx context.Context, tx *sql.Tx, statements ...string) error {
+	for _, s := range statements {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // WriteXML writes the map index to ${name}/${name}.otrk2.xml.
+// If name is a path, the last element is used as the map name.
 func (m Map) WriteXML(name string) error {
 	t := template.Must(template.New("xml").Parse(xmlTemplate))
 	type xmlLayer struct {
@@ -104,15 +398,18 @@ func (m Map) WriteXML(name string) error {
 	}
 	type xmlMap struct {
 		Name   string
+		Size   int
 		Layers []xmlLayer
 	}
-	xmlName := filepath.Join(name, name+".otrk2.xml")
+	dir, name := name, filepath.Base(name)
+	xmlName := filepath.Join(dir, name+".otrk2.xml")
 	if f, err := os.Create(xmlName); err != nil {
 		return err
 	} else {
 		defer f.Close()
 		x := xmlMap{
 			Name: name,
+			Size: m.size(),
 		}
 		x.Layers = make([]xmlLayer, len(m.ZoomLevels))
 		for i, z := range m.ZoomLevels {
@@ -133,37 +430,93 @@ func (m Map) WriteXML(name string) error {
 	}
 }
 
+// bounds returns m with the rectangle set to the bounds of the region.
+func (m Map) bounds() Map {
+	if m.Region != nil {
+		m.TopLeft, m.BottomRight = m.Region.Bounds()
+	}
+	return m
+}
+
+// bbox returns the bounding box of the map corners.
+func (m Map) bbox() tile.BBox {
+	return tile.BBoxCorners(m.TopLeft, m.BottomRight)
+}
+
+// contains returns true, if the tile is part of the region of the map.
+func (m Map) contains(z, x, y int) bool {
+	return m.Region == nil || m.Region.Intersects(z, x, y)
+}
+
+// includes returns true, if a tile from a SparseServer belongs to the map:
+// It's zoom level is one of the ZoomLevels and it is within the tile range of the map and it's region.
+func (m Map) includes(z, x, y int) bool {
+	if !slices.Contains(m.ZoomLevels, z) {
+		return false
+	}
+	r, err := m.bbox().TileRange(z)
+	return err == nil && r.Contains(x, y) && m.contains(z, x, y)
+}
+
+// size returns the tile size of the map.
+func (m Map) size() int {
+	if m.TileSize == 0 {
+		return tile.TileSize
+	}
+	return m.TileSize
+}
+
 // expandTileCorners returns the topLeft and bottomRight coordinates of the tile corners
 // for the given zoom level and the number of tiles in x and y direction.
+// For a map crossing the antimeridian, the longitude of bottomRight is larger than 180°.
 func (m Map) expandTileCorners(zoom int) (tl tile.LatLon, br tile.LatLon, nx, ny int, err error) {
-	var xy tile.XY
-	if xy, err = m.TopLeft.XY(zoom); err != nil {
+	r, err := m.bbox().TileRange(zoom)
+	if err != nil {
 		return tl, br, 0, 0, err
-	} else {
-		xy.XP, xy.YP = 0, 0
-		tl = xy.LatLon()
-		nx, ny = xy.X, xy.Y
 	}
-	if xy, err = m.BottomRight.XY(zoom); err != nil {
-		return tl, br, 0, 0, err
-	} else {
-		xy.XP, xy.YP = 255, 255
-		br = xy.LatLon()
-		nx = xy.X - nx + 1
-		ny = xy.Y - ny + 1
+	a := tile.XY{X: r.X0, Y: r.Y0, Z: zoom, Size: m.size()}
+	b := tile.XY{X: r.X1, Y: r.Y1, Z: zoom, XP: m.size() - 1, YP: m.size() - 1, Size: m.size()}
+	nx, ny = r.Size()
+	return a.LatLon(), b.LatLon(), nx, ny, nil
+}
+
+// validate returns an error, if the map or it's region is empty or the corners cannot be represented by tiles.
+func (m Map) validate() error {
+	if len(m.ZoomLevels) == 0 {
+		return errors.New("orux: map has no zoom levels")
+	}
+	if err := validateRegion(m.Region); err != nil {
+		return err
+	}
+	for i, z := range m.ZoomLevels {
+		if z < 0 || z > 24 {
+			return fmt.Errorf("orux: zoom level %d: %w", z, tile.ZoomRangeError)
+		} else if slices.Contains(m.ZoomLevels[:i], z) {
+			return fmt.Errorf("orux: duplicate zoom level %d", z)
+		}
 	}
-	return tl, br, nx, ny, nil
+	for i, c := range []tile.LatLon{m.TopLeft, m.BottomRight} {
+		corner := []string{"top left", "bottom right"}[i]
+		if c.Lon < -180 || c.Lon > 180 {
+			return fmt.Errorf("orux: %s longitude %v is out of range [-180, 180]", corner, float64(c.Lon))
+		}
+		for _, z := range m.ZoomLevels {
+			if c.Lat > tile.MaxLatitude || c.Lat < tile.MinLatitude(z) {
+				return fmt.Errorf("orux: %s latitude %v is out of range [%v, %v] for zoom level %d", corner, float64(c.Lat), float64(tile.MinLatitude(z)), float64(tile.MaxLatitude), z)
+			}
+		}
+	}
+	if m.TopLeft.Lat < m.BottomRight.Lat {
+		return fmt.Errorf("orux: top left latitude %v is south of bottom right latitude %v", float64(m.TopLeft.Lat), float64(m.BottomRight.Lat))
+	}
+	return nil
 }
 
-const sqlStart = `
-PRAGMA foreign_keys=OFF;
-BEGIN TRANSACTION;
-CREATE TABLE tiles (x int, y int, z int, image blob, PRIMARY KEY (x,y,z));
-`
+const sqlCreate = `CREATE TABLE tiles (x int, y int, z int, image blob, PRIMARY KEY (x,y,z))`
 
-const sqlEnd = `CREATE INDEX IND on tiles (x,y,z);
-COMMIT;
-`
+const sqlInsert = `INSERT OR REPLACE INTO tiles VALUES(?,?,?,?)`
+
+const sqlIndex = `CREATE INDEX IF NOT EXISTS IND on tiles (x,y,z)`
 
 const xmlTemplate = `<?xml version="1.0" encoding="UTF-8"?>
 <OruxTracker xmlns="http://oruxtracker.com/app/res/calibration"
@@ -175,8 +528,8 @@ const xmlTemplate = `<?xml version="1.0" encoding="UTF-8"?>
 			 versionCode="2.1">
 			<MapCalibration layers="false" layerLevel="{{$x.Zoom}}">
 				<MapName><![CDATA[{{$x.Name}}]]></MapName>
-				<MapChunks xMax="{{$x.Xmax}}" yMax="{{$x.Ymax}}" datum="WGS84" projection="Mercator" img_height="256" img_width="256" file_name="{{$x.Name}}" />
-				<MapDimensions height="256" width="256" />
+				<MapChunks xMax="{{$x.Xmax}}" yMax="{{$x.Ymax}}" datum="WGS84" projection="Mercator" img_height="{{$.Size}}" img_width="{{$.Size}}" file_name="{{$x.Name}}" />
+				<MapDimensions height="{{$.Size}}" width="{{$.Size}}" />
 				<MapBounds minLat="{{$x.MinLat}}" maxLat="{{$x.MaxLat}}" minLon="{{$x.MinLon}}" maxLon="{{$x.MinLon}}" />
 				<CalibrationPoints>
 					<CalibrationPoint corner="TL" lon="{{$x.MinLon}}" lat="{{$x.MaxLat}}" />
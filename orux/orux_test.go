@@ -1,12 +1,28 @@
 package orux
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ktye/map/tile"
+	_ "modernc.org/sqlite"
 )
 
+// center returns the coordinates of the center of a tile.
+func center(z, x, y int) tile.LatLon {
+	return tile.XY{X: x, Y: y, Z: z, XP: 128, YP: 128}.LatLon()
+}
+
 func TestOrux(t *testing.T) {
 
 	var ts tile.LocalServer = "test"
@@ -19,6 +35,438 @@ func TestOrux(t *testing.T) {
 	if err := m.Encode("Alster", ts); err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll("Alster")
+
+	db, err := sql.Open(tile.SQLDriver, filepath.Join("Alster", "OruxMapsImages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM tiles`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("no tiles have been written")
+	}
+}
+
+// emptyServer returns tiles, that cannot be encoded.
+type emptyServer struct{}
+
+func (emptyServer) Get(z, x, y int) (tile.Tile, error) {
+	return image.NewRGBA(image.Rectangle{}), nil
+}
+
+func TestOruxEncodeError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "empty")
+	var last Progress
+	m := Map{
+		TopLeft:     tile.LatLon{53.58914, 9.99786},
+		BottomRight: tile.LatLon{53.57668, 10.01678},
+		ZoomLevels:  []int{13},
+		Progress:    func(p Progress) { last = p },
+	}
+	err := m.Encode(dir, emptyServer{})
+	var e *EncodeError
+	if !errors.As(err, &e) {
+		t.Fatalf("expected an EncodeError: %v", err)
+	}
+	if last.Zoom != 13 || last.Done != last.Total || len(e.Tiles) != last.Total {
+		t.Fatalf("progress %+v, %d failed tiles", last, len(e.Tiles))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "empty.otrk2.xml")); err != nil {
+		t.Fatal(err)
+	}
+
+	dir = filepath.Join(t.TempDir(), "failfast")
+	m.FailFast = true
+	err = m.Encode(dir, emptyServer{})
+	var te TileError
+	if !errors.As(err, &te) || errors.As(err, &e) {
+		t.Fatalf("expected a TileError: %v", err)
+	}
+	if last.Done != 1 {
+		t.Fatalf("fail fast did not stop: %+v", last)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatal("directory of the failed map has not been removed")
+	}
+
+	// A cancelled map can be encoded again.
+	m.FailFast, m.Progress = false, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.EncodeContext(ctx, dir, &tile.UniformServer{Color: color.White}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled: %v", err)
+	}
+	if err := m.Encode(dir, &tile.UniformServer{Color: color.White}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOruxUpdate(t *testing.T) {
+	var ts tile.LocalServer = "test"
+	dir := filepath.Join(t.TempDir(), "update")
+
+	// Start with a single tile and extend the map to the top left and to a lower zoom level.
+	m := Map{TopLeft: center(15, 17295, 10585), BottomRight: center(15, 17295, 10585), ZoomLevels: []int{15}}
+	if err := m.Encode(dir, ts); err != nil {
+		t.Fatal(err)
+	}
+	m = Map{TopLeft: center(15, 17294, 10584), BottomRight: center(15, 17294, 10584), ZoomLevels: []int{13}}
+	if err := m.Update(dir, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	u, origins, err := readXML(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.ZoomLevels) != 2 || origins[13] != [2]int{4323, 2646} || origins[15] != [2]int{17294, 10584} {
+		t.Fatalf("zoom levels %v, origins %v", u.ZoomLevels, origins)
+	}
+
+	db, err := sql.Open(tile.SQLDriver, filepath.Join(dir, "OruxMapsImages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, xyz := range [][3]int{{0, 0, 13}, {1, 1, 15}} {
+		var n int
+		if err := db.QueryRow(`SELECT count(*) FROM tiles WHERE x=? AND y=? AND z=?`, xyz[0], xyz[1], xyz[2]).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if n != 1 {
+			t.Fatalf("tile %v is missing", xyz)
+		}
+	}
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM tiles`).Scan(&n); err != nil || n != 2 {
+		t.Fatalf("expected 2 tiles: %d %v", n, err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	var ts tile.LocalServer = "test"
+	dir := filepath.Join(t.TempDir(), "Alster")
+	m := Map{
+		TopLeft:     tile.LatLon{53.58914, 9.99786},
+		BottomRight: tile.LatLon{53.57668, 10.01678},
+		ZoomLevels:  []int{13, 15},
+	}
+	if err := m.Encode(dir, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.Map.ZoomLevels) != 2 || r.TileSize() != tile.TileSize {
+		t.Fatalf("map: %+v", r.Map)
+	}
+	want, _ := ts.Get(15, 17295, 10586)
+	if got, err := r.Get(15, 17295, 10586); err != nil {
+		t.Fatal(err)
+	} else if got.At(10, 20) != want.At(10, 20) {
+		t.Fatalf("got %v want %v", got.At(10, 20), want.At(10, 20))
+	}
+	if got, err := r.Get(15, 1, 1); err != nil || got.At(0, 0) != (color.RGBA{0, 0, 0, 255}) {
+		t.Fatalf("expected a black tile: %v", err)
+	} else if again, _ := r.Get(15, 1, 1); again == got {
+		t.Fatal("black tile is shared")
+	}
+
+	n := 0
+	for {
+		z, x, y, tl, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ts.Get(z, x, y); err != nil || tl == nil {
+			t.Fatalf("unexpected tile %d/%d/%d", z, x, y)
+		}
+		n++
+	}
+	if n != 7 {
+		t.Fatalf("expected 7 tiles, got %d", n)
+	}
+
+	// Export a subset of the zoom levels and of the rectangle.
+	for _, s := range []Map{
+		{TopLeft: m.TopLeft, BottomRight: m.BottomRight, ZoomLevels: []int{13}},
+		{TopLeft: center(15, 17295, 10586), BottomRight: center(15, 17295, 10586), ZoomLevels: []int{15}},
+	} {
+		r, err := Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		sub := filepath.Join(t.TempDir(), "sub")
+		if err := s.Encode(sub, r); err != nil {
+			t.Fatal(err)
+		}
+		totals := s.totals()
+		db, err := sql.Open(tile.SQLDriver, filepath.Join(sub, "OruxMapsImages.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var n, z int
+		if err := db.QueryRow(`SELECT count(*), max(z) FROM tiles`).Scan(&n, &z); err != nil {
+			t.Fatal(err)
+		} else if z != s.ZoomLevels[0] || n != totals[z] {
+			t.Fatalf("%v: got %d tiles up to zoom level %d, expected %v", s.ZoomLevels, n, z, totals)
+		}
+	}
+}
+
+func TestRegion(t *testing.T) {
+	count := func(r Region, z int) (n int) {
+		tl, br := r.Bounds()
+		a, _ := tl.XY(z)
+		b, _ := br.XY(z)
+		for x := a.X; x <= b.X; x++ {
+			for y := a.Y; y <= b.Y; y++ {
+				if r.Intersects(z, x, y) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	// A diagonal track through 10 tiles.
+	track := []tile.LatLon{center(15, 17200, 17200), center(15, 17209, 17209)}
+	if n := count(Corridor{Track: track, Width: 1}, 15); n != 10+2*9 {
+		// The diagonal also touches the corners of the neighbouring tiles.
+		t.Fatalf("narrow corridor: %d tiles", n)
+	}
+	if n := count(Corridor{Track: track[:1], Width: 1}, 15); n != 1 {
+		t.Fatalf("single point corridor: %d tiles", n)
+	}
+	if n := count(Corridor{Track: track, Width: 2000}, 15); n <= 28 || n >= 200 {
+		t.Fatalf("wide corridor: %d tiles", n)
+	}
 
-	os.RemoveAll("Alster")
+	// A triangle covering the lower left half of a 10x10 tile square.
+	p := Polygon{center(15, 17200, 17200), center(15, 17200, 17209), center(15, 17209, 17209)}
+	if n := count(p, 15); n < 55 || n >= 100 {
+		t.Fatalf("polygon: %d tiles", n)
+	}
+	if p.Intersects(15, 17209, 17200) {
+		t.Fatal("polygon intersects the opposite corner")
+	}
+
+	r := Rectangles{{center(15, 100, 100), center(15, 101, 101)}, {center(15, 105, 105), center(15, 105, 106)}}
+	if n := count(r, 15); n != 6 {
+		t.Fatalf("rectangles: %d tiles", n)
+	}
+}
+
+func TestOruxRegion(t *testing.T) {
+	var ts tile.LocalServer = "test"
+	dir := filepath.Join(t.TempDir(), "region")
+	m := Map{
+		ZoomLevels: []int{15},
+		Region:     Corridor{Track: []tile.LatLon{center(15, 17294, 10584), center(15, 17294, 10586)}, Width: 10},
+	}
+	if err := m.Encode(dir, ts); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	n := 0
+	for {
+		_, x, _, _, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if x != 17294 {
+			t.Fatalf("tile outside of the corridor: x=%d", x)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 tiles, got %d", n)
+	}
+}
+
+// slowServer counts the maximal number of concurrent requests.
+type slowServer struct {
+	local   tile.LocalServer
+	mu      sync.Mutex
+	n, maxN int
+}
+
+func (s *slowServer) Get(z, x, y int) (tile.Tile, error) {
+	s.mu.Lock()
+	s.n++
+	s.maxN = max(s.maxN, s.n)
+	s.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	s.mu.Lock()
+	s.n--
+	s.mu.Unlock()
+	return s.local.Get(z, x, y)
+}
+
+func TestOruxConcurrency(t *testing.T) {
+	s := &slowServer{local: "test"}
+	dir := filepath.Join(t.TempDir(), "concurrent")
+	var order [][2]int
+	m := Map{
+		TopLeft:     tile.LatLon{53.58914, 9.99786},
+		BottomRight: tile.LatLon{53.57668, 10.01678},
+		ZoomLevels:  []int{13, 15},
+		Concurrency: 4,
+		Progress:    func(p Progress) { order = append(order, [2]int{p.Zoom, p.Done}) },
+	}
+	if err := m.Encode(dir, s); err != nil {
+		t.Fatal(err)
+	}
+	if s.maxN < 2 || s.maxN > 4 {
+		t.Fatalf("max concurrent requests: %d", s.maxN)
+	}
+	want := [][2]int{{13, 1}, {15, 1}, {15, 2}, {15, 3}, {15, 4}, {15, 5}, {15, 6}}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Fatalf("progress: %v", order)
+	}
+
+	// Fail fast stops the workers.
+	s = &slowServer{local: "test"}
+	m.FailFast, m.Progress = true, nil
+	m.TopLeft.Lat += 0.01 // tiles outside of the test data fail
+	if err := m.Encode(filepath.Join(t.TempDir(), "failfast"), s); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestOruxValidate(t *testing.T) {
+	ts := &tile.UniformServer{Color: color.White}
+	for _, m := range []Map{
+		{TopLeft: tile.LatLon{50, 10}, BottomRight: tile.LatLon{49, 11}},
+		{TopLeft: tile.LatLon{50, 10}, BottomRight: tile.LatLon{49, 11}, ZoomLevels: []int{25}},
+		{TopLeft: tile.LatLon{89, 10}, BottomRight: tile.LatLon{49, 11}, ZoomLevels: []int{5}},
+		{TopLeft: tile.LatLon{50, 10}, BottomRight: tile.LatLon{49, 190}, ZoomLevels: []int{5}},
+		{TopLeft: tile.LatLon{49, 10}, BottomRight: tile.LatLon{50, 11}, ZoomLevels: []int{5}},
+		{TopLeft: tile.LatLon{50, 10}, BottomRight: tile.LatLon{49, 11}, ZoomLevels: []int{5, 6, 5}},
+		{Region: Polygon{}, ZoomLevels: []int{5}},
+		{Region: Polygon{{50, 10}, {49, 11}}, ZoomLevels: []int{5}},
+		{Region: Corridor{Width: 100}, ZoomLevels: []int{5}},
+		{Region: Corridor{Track: []tile.LatLon{{50, 10}, {49, 11}}}, ZoomLevels: []int{5}},
+		{Region: Rectangles{}, ZoomLevels: []int{5}},
+	} {
+		dir := filepath.Join(t.TempDir(), "invalid")
+		if err := m.Encode(dir, ts); err == nil {
+			t.Fatalf("expected an error for %+v", m)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatal("directory has been created for an invalid map")
+		}
+	}
+}
+
+func TestOruxAntimeridian(t *testing.T) {
+	ts := &tile.UniformServer{Color: color.White}
+	dir := filepath.Join(t.TempDir(), "fiji")
+	m := Map{
+		TopLeft:     tile.LatLon{-16, 179.9},
+		BottomRight: tile.LatLon{-16.1, -179.9},
+		ZoomLevels:  []int{8},
+	}
+	if err := m.Encode(dir, ts); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var xs []int
+	for {
+		_, x, _, _, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		xs = append(xs, x)
+	}
+	if fmt.Sprint(xs) != "[255 0]" && fmt.Sprint(xs) != "[0 255]" {
+		t.Fatalf("tiles: %v", xs)
+	}
+	y, _ := tile.LatLon{-16, 0}.XY(8)
+	for _, x := range []int{0, 255} {
+		if got, err := r.Get(8, x, y.Y); err != nil || got.At(0, 0) != (color.RGBA{255, 255, 255, 255}) {
+			t.Fatalf("tile x=%d is not white: %v", x, err)
+		}
+	}
+	if _, br, nx, _, _ := r.Map.expandTileCorners(8); nx != 2 || br.Lon < 180 {
+		t.Fatalf("calibration: nx=%d br=%v", nx, br)
+	}
+}
+
+func TestExport(t *testing.T) {
+	var ts tile.LocalServer = "test"
+	m := Map{
+		TopLeft:     tile.LatLon{53.58914, 9.99786},
+		BottomRight: tile.LatLon{53.57668, 10.01678},
+		ZoomLevels:  []int{13, 15},
+	}
+	dir := t.TempDir()
+
+	rmaps := filepath.Join(dir, "alster.sqlitedb")
+	if err := m.EncodeRMaps(rmaps, ts); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.EncodeRMaps(rmaps, ts); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected ErrExist: %v", err)
+	}
+	db, err := sql.Open(tile.SQLDriver, rmaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n, minzoom, maxzoom int
+	if err := db.QueryRow(`SELECT count(*) FROM tiles WHERE x=17295 AND y=10586 AND z=2 AND s=0`).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("rmaps tile: %d %v", n, err)
+	}
+	if err := db.QueryRow(`SELECT minzoom, maxzoom FROM info`).Scan(&minzoom, &maxzoom); err != nil || minzoom != 2 || maxzoom != 4 {
+		t.Fatalf("rmaps info: %d %d %v", minzoom, maxzoom, err)
+	}
+
+	file := filepath.Join(dir, "alster.mbtiles")
+	if err := m.EncodeMBTiles(file, ts); err != nil {
+		t.Fatal(err)
+	}
+	mb, err := tile.OpenMBTiles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mb.Close()
+	want, _ := ts.Get(15, 17295, 10586)
+	if got, err := mb.Get(15, 17295, 10586); err != nil {
+		t.Fatal(err)
+	} else if got.At(10, 20) != want.At(10, 20) {
+		t.Fatalf("got %v want %v", got.At(10, 20), want.At(10, 20))
+	}
+	if md, err := mb.Metadata(); err != nil || md.Name != "alster" || md.MinZoom != 13 || md.MaxZoom != 15 || md.Bounds[1] != 53.57668 {
+		t.Fatalf("metadata: %+v %v", md, err)
+	}
+
+	// The file is removed, if the map cannot be written.
+	m.FailFast = true
+	file = filepath.Join(dir, "empty.mbtiles")
+	if err := m.EncodeMBTiles(file, emptyServer{}); err == nil {
+		t.Fatal("expected an error")
+	} else if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("file has not been removed")
+	}
 }
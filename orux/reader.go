@@ -0,0 +1,125 @@
+package orux
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image/color"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/ktye/map/tile"
+)
+
+// Reader serves the tiles of an existing map as a tile.SparseServer.
+type Reader struct {
+	Map     Map // Rectangle, zoom levels and tile size of the map.
+	db      *sql.DB
+	origins map[int][2]int // top left tile numbers for each zoom level
+	mu      sync.Mutex
+	rows    *sql.Rows // iterator for Next
+	done    bool
+}
+
+// Open opens the map in the directory name, that contains name.otrk2.xml and OruxMapsImages.db.
+func Open(name string) (*Reader, error) {
+	m, origins, err := readXML(name)
+	if err != nil {
+		return nil, err
+	}
+	file := filepath.Join(name, "OruxMapsImages.db")
+	db, err := sql.Open(tile.SQLDriver, "file:"+file+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM tiles LIMIT 1`).Scan(&n); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return &Reader{Map: m, db: db, origins: origins}, nil
+}
+
+// Close closes the database.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rows != nil {
+		r.rows.Close()
+	}
+	return r.db.Close()
+}
+
+// Get returns the tile with the global tile numbers x and y.
+// It returns a new black tile, if it is not contained in the map.
+func (r *Reader) Get(z, x, y int) (tile.Tile, error) {
+	o, ok := r.origins[z]
+	if !ok {
+		return r.blackTile(), nil
+	}
+	// Maps crossing the antimeridian continue with wrapped tile numbers.
+	dx := x - o[0]
+	if n := tile.NumTiles(z); dx < 0 {
+		dx += n
+	} else if dx >= n {
+		dx -= n
+	}
+	var b []byte
+	if err := r.db.QueryRow(`SELECT image FROM tiles WHERE x=? AND y=? AND z=?`, dx, y-o[1], z).Scan(&b); err == sql.ErrNoRows {
+		return r.blackTile(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	t, _, err := tile.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("orux: tile %d/%d/%d: %s", z, x, y, err)
+	}
+	return t, nil
+}
+
+// blackTile returns a black tile of the map's tile size.
+// It is not shared, as the caller may draw on it.
+func (r *Reader) blackTile() tile.Tile {
+	t, _ := (&tile.UniformServer{Color: color.Black, Size: r.Map.size()}).Get(0, 0, 0)
+	return t
+}
+
+// Next iterates over all tiles of the map ordered by zoom level.
+// It returns io.EOF after the last tile.
+func (r *Reader) Next() (z, x, y int, t tile.Tile, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return 0, 0, 0, nil, io.EOF
+	}
+	if r.rows == nil {
+		if r.rows, err = r.db.Query(`SELECT x, y, z, image FROM tiles ORDER BY z, x, y`); err != nil {
+			return 0, 0, 0, nil, err
+		}
+	}
+	if !r.rows.Next() {
+		err = r.rows.Err()
+		r.rows.Close()
+		r.rows, r.done = nil, true
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, 0, 0, nil, err
+	}
+	var b []byte
+	if err = r.rows.Scan(&x, &y, &z, &b); err != nil {
+		return 0, 0, 0, nil, err
+	}
+	o := r.origins[z]
+	x, y = (x+o[0])%tile.NumTiles(z), y+o[1]
+	if t, _, err = tile.Decode(bytes.NewReader(b)); err != nil {
+		err = fmt.Errorf("orux: tile %d/%d/%d: %s", z, x, y, err)
+	}
+	return z, x, y, t, err
+}
+
+// TileSize returns the tile size of the map.
+func (r *Reader) TileSize() int {
+	return r.Map.size()
+}
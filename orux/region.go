@@ -0,0 +1,213 @@
+package orux
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ktye/map/tile"
+)
+
+// Region is the area of a map.
+// Only tiles intersecting the region are written.
+// The calibration of the map is defined by the bounding box of the region.
+type Region interface {
+	Bounds() (topLeft, bottomRight tile.LatLon)
+	Intersects(z, x, y int) bool // Intersects returns true, if the tile z/x/y intersects the region.
+}
+
+// Rectangle is a Region between two corners.
+type Rectangle struct {
+	TopLeft, BottomRight tile.LatLon
+}
+
+// Bounds returns the corners of r.
+func (r Rectangle) Bounds() (tile.LatLon, tile.LatLon) {
+	return r.TopLeft, r.BottomRight
+}
+
+// Intersects returns true, if the tile is within the tile range of r.
+// The rectangle crosses the antimeridian, if TopLeft.Lon is larger than BottomRight.Lon.
+func (r Rectangle) Intersects(z, x, y int) bool {
+	t, err := tile.BBoxCorners(r.TopLeft, r.BottomRight).TileRange(z)
+	return err == nil && t.Contains(x, y)
+}
+
+// Rectangles is a Region, that is the union of multiple rectangles.
+type Rectangles []Rectangle
+
+// Bounds returns the bounding box of all rectangles.
+func (r Rectangles) Bounds() (tl, br tile.LatLon) {
+	var b tile.BBox
+	for i, x := range r {
+		if i == 0 {
+			b = tile.BBoxCorners(x.TopLeft, x.BottomRight)
+		} else {
+			b = b.Union(tile.BBoxCorners(x.TopLeft, x.BottomRight))
+		}
+	}
+	return b.TopLeft(), b.BottomRight()
+}
+
+// Intersects returns true, if any rectangle intersects the tile.
+func (r Rectangles) Intersects(z, x, y int) bool {
+	for _, x0 := range r {
+		if x0.Intersects(z, x, y) {
+			return true
+		}
+	}
+	return false
+}
+
+// Polygon is a Region enclosed by a closed polygon.
+// The last point connects to the first.
+// Edges are straight lines in the mercator projection.
+// The polygon must not cross the antimeridian.
+type Polygon []tile.LatLon
+
+// Bounds returns the bounding box of the polygon.
+func (p Polygon) Bounds() (tl, br tile.LatLon) {
+	b := tile.BBoxOf(p...)
+	return b.TopLeft(), b.BottomRight()
+}
+
+// Intersects returns true, if the tile intersects the polygon.
+func (p Polygon) Intersects(z, x, y int) bool {
+	if len(p) == 0 {
+		return false
+	}
+	r := [4]float64{float64(x), float64(y), float64(x + 1), float64(y + 1)}
+	v := make([][2]float64, len(p))
+	for i, ll := range p {
+		v[i] = project(ll, z)
+		if inRect(v[i], r) {
+			return true
+		}
+	}
+	for i := range v {
+		if segmentRect(v[i], v[(i+1)%len(v)], r) == 0 {
+			return true
+		}
+	}
+	// The tile may be completely inside the polygon.
+	return inPolygon([2]float64{r[0] + 0.5, r[1] + 0.5}, v)
+}
+
+// Corridor is a Region within the distance Width around a track, e.g. a hiking route.
+// The track must not cross the antimeridian.
+type Corridor struct {
+	Track []tile.LatLon
+	Width tile.Meter // Distance to each side of the track.
+}
+
+// Bounds returns the bounding box of the track extended by the width of the corridor.
+func (c Corridor) Bounds() (tl, br tile.LatLon) {
+	b := tile.BBoxOf(c.Track...).Expand(c.Width)
+	tl, br = b.TopLeft(), b.BottomRight()
+	tl.Lat, br.Lat = min(tl.Lat, tile.MaxLatitude), max(br.Lat, -tile.MaxLatitude)
+	return tl, br
+}
+
+// Intersects returns true, if the tile is closer to the track than the width of the corridor.
+func (c Corridor) Intersects(z, x, y int) bool {
+	r := [4]float64{float64(x), float64(y), float64(x + 1), float64(y + 1)}
+	for i := range c.Track {
+		a := project(c.Track[i], z)
+		b := a
+		if i+1 < len(c.Track) {
+			b = project(c.Track[i+1], z)
+		}
+		// Length of a tile edge in meters at the latitude of the segment.
+		lat := (c.Track[i].Lat + c.Track[min(i+1, len(c.Track)-1)].Lat) / 2
+		edge := 2 * math.Pi * float64(tile.EarthRadius) * math.Cos(lat.Radians()) / math.Exp2(float64(z))
+		if segmentRect(a, b, r)*edge <= float64(c.Width) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRegion returns an error for an empty or degenerate region, which contains no tiles.
+func validateRegion(r Region) error {
+	switch r := r.(type) {
+	case Rectangles:
+		if len(r) == 0 {
+			return errors.New("orux: region has no rectangles")
+		}
+	case Polygon:
+		if len(r) < 3 {
+			return fmt.Errorf("orux: polygon region has %d points, at least 3 are needed", len(r))
+		}
+	case Corridor:
+		if len(r.Track) == 0 {
+			return errors.New("orux: corridor region has no track")
+		} else if r.Width <= 0 {
+			return fmt.Errorf("orux: corridor width %v is not positive", float64(r.Width))
+		}
+	}
+	return nil
+}
+
+// project returns the fractional tile numbers of ll at zoom level z.
+func project(ll tile.LatLon, z int) [2]float64 {
+	ll.Lat = max(min(ll.Lat, tile.MaxLatitude), -tile.MaxLatitude)
+	x, y := ll.World().Pixel(z, 1)
+	return [2]float64{x, y}
+}
+
+// inRect returns true, if p is inside the rectangle r {x0, y0, x1, y1}.
+func inRect(p [2]float64, r [4]float64) bool {
+	return p[0] >= r[0] && p[0] <= r[2] && p[1] >= r[1] && p[1] <= r[3]
+}
+
+// inPolygon returns true, if p is inside the polygon v (even-odd rule).
+func inPolygon(p [2]float64, v [][2]float64) bool {
+	in := false
+	for i, j := 0, len(v)-1; i < len(v); j, i = i, i+1 {
+		a, b := v[i], v[j]
+		if (a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			in = !in
+		}
+	}
+	return in
+}
+
+// segmentRect returns the distance between the segment ab and the rectangle r.
+// It is 0, if they intersect.
+func segmentRect(a, b [2]float64, r [4]float64) float64 {
+	if inRect(a, r) || inRect(b, r) {
+		return 0
+	}
+	c := [4][2]float64{{r[0], r[1]}, {r[2], r[1]}, {r[2], r[3]}, {r[0], r[3]}}
+	d := math.Inf(1)
+	for i := range c {
+		p, q := c[i], c[(i+1)%4]
+		if segmentsIntersect(a, b, p, q) {
+			return 0
+		}
+		d = math.Min(d, pointSegment(p, a, b))
+		d = math.Min(d, pointSegment(a, p, q))
+		d = math.Min(d, pointSegment(b, p, q))
+	}
+	return d
+}
+
+// segmentsIntersect returns true, if the segments ab and cd intersect.
+func segmentsIntersect(a, b, c, d [2]float64) bool {
+	cross := func(o, p, q [2]float64) float64 {
+		return (p[0]-o[0])*(q[1]-o[1]) - (p[1]-o[1])*(q[0]-o[0])
+	}
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	return ((d1 > 0) != (d2 > 0)) && ((d3 > 0) != (d4 > 0))
+}
+
+// pointSegment returns the distance between p and the segment ab.
+func pointSegment(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, ((p[0]-a[0])*dx+(p[1]-a[1])*dy)/l))
+	}
+	return math.Hypot(p[0]-a[0]-t*dx, p[1]-a[1]-t*dy)
+}
@@ -0,0 +1,180 @@
+package orux
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ktye/map/tile"
+)
+
+// Update extends an existing map in the directory name, which has been written by Encode.
+// It adds or replaces the tiles of m in OruxMapsImages.db and rewrites the index file
+// for the union of the existing and the new rectangle and zoom levels.
+// Existing tiles outside of m are kept, but the area, that is neither covered by the old map
+// nor by m for a zoom level, remains empty.
+// Errors are reported as by Encode. If the database cannot be updated, it is left unmodified.
+func (m Map) Update(name string, ts tile.Server) error {
+	return m.UpdateContext(context.Background(), name, ts)
+}
+
+// UpdateContext is Update with a context.
+func (m Map) UpdateContext(ctx context.Context, name string, ts tile.Server) error {
+	old, origins, err := readXML(name)
+	if err != nil {
+		return err
+	}
+	m = m.bounds()
+	if err := m.validate(); err != nil {
+		return err
+	}
+	if m.bbox().CrossesAntimeridian() || old.bbox().CrossesAntimeridian() {
+		return errors.New("orux: update of a map crossing the antimeridian is not supported")
+	}
+	if m.TileSize == 0 {
+		m.TileSize = tile.SizeOf(ts)
+	}
+	if m.TileSize != old.size() {
+		return fmt.Errorf("orux: tile size %d does not match the existing map (%d)", m.TileSize, old.size())
+	}
+	u := m.union(old)
+
+	// Shift the existing tiles, if the top left corner moves.
+	shift := func(ctx context.Context, tx *sql.Tx) error {
+		for z, o := range origins {
+			tl, err := u.TopLeft.XY(z)
+			if err != nil {
+				return err
+			}
+			dx, dy := o[0]-tl.X, o[1]-tl.Y
+			if dx == 0 && dy == 0 {
+				continue
+			}
+			// Move to negative values first, to avoid primary key conflicts.
+			if _, err := tx.ExecContext(ctx, `UPDATE tiles SET x=-(x+?)-1, y=-(y+?)-1 WHERE z=?`, dx, dy, z); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE tiles SET x=-x-1, y=-y-1 WHERE z=?`, z); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dbfile := filepath.Join(name, "OruxMapsImages.db")
+	if _, err := os.Stat(dbfile); err != nil {
+		return err
+	}
+	failed, err := m.writeDB(ctx, dbfile, ts, oruxFormat(u.TopLeft, shift))
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if err := u.WriteXML(name); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &EncodeError{Tiles: failed}
+	}
+	return nil
+}
+
+// union returns a map covering the rectangles and zoom levels of m and o.
+func (m Map) union(o Map) Map {
+	u := m
+	u.Region = nil
+	b := m.bbox().Union(o.bbox())
+	u.TopLeft, u.BottomRight = b.TopLeft(), b.BottomRight()
+	zoom := make(map[int]bool)
+	u.ZoomLevels = nil
+	for _, z := range append(append([]int{}, m.ZoomLevels...), o.ZoomLevels...) {
+		if !zoom[z] {
+			zoom[z] = true
+			u.ZoomLevels = append(u.ZoomLevels, z)
+		}
+	}
+	sort.Ints(u.ZoomLevels)
+	return u
+}
+
+// calibration is the part of the index file, that is needed by Update.
+type calibration struct {
+	Layers []struct {
+		Zoom   int `xml:"layerLevel,attr"`
+		Chunks struct {
+			ImgWidth int `xml:"img_width,attr"`
+		} `xml:"MapChunks"`
+		Points []struct {
+			Corner string  `xml:"corner,attr"`
+			Lat    float64 `xml:"lat,attr"`
+			Lon    float64 `xml:"lon,attr"`
+		} `xml:"CalibrationPoints>CalibrationPoint"`
+	} `xml:"MapCalibration>OruxTracker>MapCalibration"`
+}
+
+// readXML reads the index file of an existing map.
+// It returns the map and the top left tile number for each zoom level.
+func readXML(name string) (Map, map[int][2]int, error) {
+	var m Map
+	file := filepath.Join(name, filepath.Base(name)+".otrk2.xml")
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return m, nil, err
+	}
+	var c calibration
+	if err := xml.Unmarshal(b, &c); err != nil {
+		return m, nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if len(c.Layers) == 0 {
+		return m, nil, fmt.Errorf("%s: no layers", file)
+	}
+
+	origins := make(map[int][2]int)
+	zmax := -1
+	for _, l := range c.Layers {
+		var tl, br *tile.LatLon
+		for _, p := range l.Points {
+			ll := tile.LatLon{tile.Degree(p.Lat), tile.Degree(p.Lon)}
+			if p.Corner == "TL" {
+				tl = &ll
+			} else if p.Corner == "BR" {
+				br = &ll
+			}
+		}
+		if tl == nil || br == nil {
+			return m, nil, fmt.Errorf("%s: layer %d: missing calibration points", file, l.Zoom)
+		}
+		m.TileSize = l.Chunks.ImgWidth
+
+		// The top left calibration point is a tile corner, which is rounded to the nearest tile.
+		xy, err := tl.XYSize(l.Zoom, m.size())
+		if err != nil {
+			return m, nil, fmt.Errorf("%s: %s", file, err)
+		}
+		x := int(math.Round(float64(xy.X) + float64(xy.XP)/float64(m.size())))
+		y := int(math.Round(float64(xy.Y) + float64(xy.YP)/float64(m.size())))
+		origins[l.Zoom] = [2]int{x, y}
+		m.ZoomLevels = append(m.ZoomLevels, l.Zoom)
+
+		// The rectangle is defined by points inside the corner tiles of the highest zoom level,
+		// which are also inside the corner tiles of all lower zoom levels.
+		if l.Zoom > zmax {
+			zmax = l.Zoom
+			m.TopLeft = tile.XY{X: x, Y: y, Z: l.Zoom, XP: 1, YP: 1, Size: m.size()}.LatLon()
+			m.BottomRight = *br
+			if m.BottomRight.Lon > 180 {
+				m.BottomRight.Lon -= 360
+			}
+		}
+	}
+	sort.Ints(m.ZoomLevels)
+	return m, origins, nil
+}
@@ -0,0 +1,223 @@
+package tile
+
+import (
+	"iter"
+	"math"
+)
+
+// BBox is a bounding box between the south west corner Min and the north east corner Max.
+// The box crosses the antimeridian, if Min.Lon is larger than Max.Lon.
+// It covers all longitudes, if Min.Lon is -180° and Max.Lon is 180°.
+type BBox struct {
+	Min, Max LatLon
+}
+
+// BBoxOf returns the smallest box containing all points.
+// The box does not cross the antimeridian.
+func BBoxOf(points ...LatLon) BBox {
+	var b BBox
+	for i, p := range points {
+		if i == 0 {
+			b = BBox{p, p}
+			continue
+		}
+		b.Min.Lat, b.Min.Lon = min(b.Min.Lat, p.Lat), min(b.Min.Lon, p.Lon)
+		b.Max.Lat, b.Max.Lon = max(b.Max.Lat, p.Lat), max(b.Max.Lon, p.Lon)
+	}
+	return b
+}
+
+// BBoxCorners returns the box between the top left and the bottom right corner.
+func BBoxCorners(topLeft, bottomRight LatLon) BBox {
+	return BBox{Min: LatLon{bottomRight.Lat, topLeft.Lon}, Max: LatLon{topLeft.Lat, bottomRight.Lon}}
+}
+
+// TopLeft returns the north west corner of b.
+func (b BBox) TopLeft() LatLon { return LatLon{b.Max.Lat, b.Min.Lon} }
+
+// BottomRight returns the south east corner of b.
+func (b BBox) BottomRight() LatLon { return LatLon{b.Min.Lat, b.Max.Lon} }
+
+// CrossesAntimeridian returns true, if b extends eastwards from Min.Lon across 180° to Max.Lon.
+func (b BBox) CrossesAntimeridian() bool {
+	return b.Min.Lon > b.Max.Lon
+}
+
+// Width returns the longitude range of b [0°, 360°].
+func (b BBox) Width() Degree {
+	if b.CrossesAntimeridian() {
+		return b.Max.Lon - b.Min.Lon + 360
+	}
+	return b.Max.Lon - b.Min.Lon
+}
+
+// Height returns the latitude range of b.
+func (b BBox) Height() Degree {
+	return b.Max.Lat - b.Min.Lat
+}
+
+// Contains returns true, if p is inside b or on its edge.
+func (b BBox) Contains(p LatLon) bool {
+	if p.Lat < b.Min.Lat || p.Lat > b.Max.Lat {
+		return false
+	}
+	if b.CrossesAntimeridian() {
+		return p.Lon >= b.Min.Lon || p.Lon <= b.Max.Lon
+	}
+	return p.Lon >= b.Min.Lon && p.Lon <= b.Max.Lon
+}
+
+// Union returns the smallest box containing b and c.
+// If neither b nor c crosses the antimeridian, the union does not cross it either.
+// Otherwise the union is the shorter of the two ways around the earth.
+func (b BBox) Union(c BBox) BBox {
+	u := BBox{Min: LatLon{Lat: min(b.Min.Lat, c.Min.Lat)}, Max: LatLon{Lat: max(b.Max.Lat, c.Max.Lat)}}
+	if !b.CrossesAntimeridian() && !c.CrossesAntimeridian() {
+		u.Min.Lon, u.Max.Lon = min(b.Min.Lon, c.Min.Lon), max(b.Max.Lon, c.Max.Lon)
+		return u
+	}
+	// Extend b eastwards to cover c, or c eastwards to cover b.
+	start, width := b.Min.Lon, max(b.Width(), compass(c.Min.Lon-b.Min.Lon)+c.Width())
+	if w := max(c.Width(), compass(b.Min.Lon-c.Min.Lon)+b.Width()); w < width {
+		start, width = c.Min.Lon, w
+	}
+	u.Min.Lon, u.Max.Lon = lonRange(start, width)
+	return u
+}
+
+// Intersection returns the box covered by both b and c.
+// It returns false, if they do not intersect.
+// Boxes, that are wider than 180°, may overlap on both ends.
+// In this case the wider of the two parts is returned.
+func (b BBox) Intersection(c BBox) (BBox, bool) {
+	var r BBox
+	r.Min.Lat, r.Max.Lat = max(b.Min.Lat, c.Min.Lat), min(b.Max.Lat, c.Max.Lat)
+	if r.Min.Lat > r.Max.Lat {
+		return BBox{}, false
+	}
+	switch {
+	case b.Width() >= 360:
+		r.Min.Lon, r.Max.Lon = c.Min.Lon, c.Max.Lon
+		return r, true
+	case c.Width() >= 360:
+		r.Min.Lon, r.Max.Lon = b.Min.Lon, b.Max.Lon
+		return r, true
+	}
+	// Intersect the longitude interval of b with c shifted by -360°, 0 and 360°.
+	b0, b1 := b.Min.Lon, b.Min.Lon+b.Width()
+	found := false
+	var start, width Degree
+	for _, shift := range []Degree{-360, 0, 360} {
+		c0, c1 := c.Min.Lon+shift, c.Min.Lon+c.Width()+shift
+		s, e := max(b0, c0), min(b1, c1)
+		if e >= s && (!found || e-s > width) {
+			start, width, found = s, e-s, true
+		}
+	}
+	if !found {
+		return BBox{}, false
+	}
+	r.Min.Lon, r.Max.Lon = lonRange(start, width)
+	return r, true
+}
+
+// Expand returns b extended by the distance d to each side.
+// The latitude is limited to the poles. The box covers all longitudes,
+// if it reaches a pole or if it extends around the earth.
+func (b BBox) Expand(d Meter) BBox {
+	dlat := degrees(float64(d / EarthRadius))
+	r := BBox{Min: LatLon{Lat: max(b.Min.Lat-dlat, -90)}, Max: LatLon{Lat: min(b.Max.Lat+dlat, 90)}}
+	lat := math.Max(math.Abs(float64(r.Min.Lat)), math.Abs(float64(r.Max.Lat)))
+	if lat >= 90 {
+		r.Min.Lon, r.Max.Lon = -180, 180
+		return r
+	}
+	dlon := Degree(float64(dlat) / math.Cos(lat*math.Pi/180))
+	r.Min.Lon, r.Max.Lon = lonRange(b.Min.Lon-dlon, b.Width()+2*dlon)
+	return r
+}
+
+// lonRange returns the longitudes of an interval with the given start and width.
+// The interval covers all longitudes, if width is 360° or more.
+func lonRange(start, width Degree) (lon0, lon1 Degree) {
+	if width >= 360 {
+		return -180, 180
+	}
+	if start < -180 {
+		start += 360
+	} else if start > 180 {
+		start -= 360
+	}
+	end := start + width
+	if end > 180 {
+		end -= 360
+	}
+	return start, end
+}
+
+// TileRange returns the range of tiles covering b at zoom level z.
+// Latitudes beyond the range of tile coordinates are limited to the first and last row of tiles.
+func (b BBox) TileRange(z int) (TileRange, error) {
+	if z < 0 || z > 24 {
+		return TileRange{}, ZoomRangeError
+	}
+	tl, br := b.TopLeft(), b.BottomRight()
+	tl.Lat, br.Lat = max(min(tl.Lat, MaxLatitude), MinLatitude(z)), max(min(br.Lat, MaxLatitude), MinLatitude(z))
+	a, _ := tl.XY(z)
+	c, _ := br.XY(z)
+	n := NumTiles(z)
+	r := TileRange{Z: z, X0: min(a.X, n-1), Y0: a.Y, X1: min(c.X, n-1), Y1: c.Y}
+	if b.CrossesAntimeridian() {
+		r.X1 = min(r.X1+n, r.X0+n-1)
+	}
+	return r, nil
+}
+
+// TileRange is a rectangular range of tiles at zoom level Z from the top left tile X0/Y0
+// to the bottom right tile X1/Y1 including.
+// If the range crosses the antimeridian, X1 is larger than NumTiles(Z)-1
+// and the range continues with tile 0 after the last tile.
+type TileRange struct {
+	Z      int
+	X0, Y0 int
+	X1, Y1 int
+}
+
+// Size returns the number of tiles in x and y direction.
+func (r TileRange) Size() (nx, ny int) {
+	return r.X1 - r.X0 + 1, r.Y1 - r.Y0 + 1
+}
+
+// Len returns the number of tiles in r.
+func (r TileRange) Len() int {
+	nx, ny := r.Size()
+	return nx * ny
+}
+
+// Contains returns true, if the tile x/y at zoom level r.Z is within r.
+// The tile number x may be wrapped.
+func (r TileRange) Contains(x, y int) bool {
+	if y < r.Y0 || y > r.Y1 {
+		return false
+	}
+	n := NumTiles(r.Z)
+	if x = (x%n + n) % n; x < r.X0 {
+		x += n
+	}
+	return x <= r.X1
+}
+
+// All iterates over the tiles of r column by column.
+// The tile numbers are normalized to [0, NumTiles(Z)-1].
+func (r TileRange) All() iter.Seq[XY] {
+	return func(yield func(XY) bool) {
+		n := NumTiles(r.Z)
+		for x := r.X0; x <= r.X1; x++ {
+			for y := r.Y0; y <= r.Y1; y++ {
+				if !yield(XY{X: x % n, Y: y, Z: r.Z}) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package tile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client requests tiles over HTTP.
+// It identifies itself, limits the load per host and retries temporary failures,
+// as required by the usage policies of public tile servers, e.g.
+// https://operations.osmfoundation.org/policies/tiles/
+//
+// The zero value is a usable Client without any limits.
+// HttpServer uses the DefaultClient.
+type Client struct {
+	HTTP      *http.Client  // Client used for the requests. If nil, http.DefaultClient is used.
+	UserAgent string        // Value of the User-Agent header.
+	Header    http.Header   // Additional request headers, e.g. Referer or an API key.
+	Timeout   time.Duration // Timeout for a single request, including reading the body. 0 means no timeout.
+
+	MaxConns int     // Maximal number of concurrent requests per host. 0 means no limit.
+	Rate     float64 // Maximal number of requests per second and host. 0 means no limit.
+
+	Retries int           // Number of retries after network errors, 429 and 5xx responses.
+	Backoff time.Duration // Wait time before the first retry. It is doubled for each further retry.
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+}
+
+// DefaultClient is used by HttpServer and by a TemplateServer without a Client.
+var DefaultClient = &Client{
+	UserAgent: "github.com/ktye/map",
+	Timeout:   30 * time.Second,
+	MaxConns:  2,
+	Retries:   3,
+	Backoff:   time.Second,
+}
+
+// hostLimit tracks the requests to a single host.
+type hostLimit struct {
+	conns chan struct{} // semaphore for MaxConns
+	next  time.Time     // earliest start of the next request
+}
+
+// StatusError is returned, if the tile server does not respond with 200 OK.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("tile server response is not ok:%d: %s: %s", e.StatusCode, e.Status, e.URL)
+}
+
+// GetTile requests a tile from url and decodes it.
+func (c *Client) GetTile(ctx context.Context, url string) (Tile, error) {
+	t, _, err := c.GetTileIfModified(ctx, url, Validity{})
+	return t, err
+}
+
+// get requests url with the additional header h and returns the response with it's body.
+// It retries temporary failures and returns a StatusError for unsuccessful responses.
+// 304 Not Modified is successful, as it is the expected answer to a conditional request.
+func (c *Client) get(ctx context.Context, url string, h http.Header) (*http.Response, []byte, error) {
+	backoff := c.Backoff
+	for try := 0; ; try++ {
+		res, body, err := c.try(ctx, url, h)
+		if err == nil && (res.StatusCode == http.StatusOK || res.StatusCode == http.StatusNotModified) {
+			return res, body, nil
+		} else if err == nil {
+			err = StatusError{URL: url, StatusCode: res.StatusCode, Status: res.Status}
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if try >= c.Retries || (res != nil && !retryStatus(res.StatusCode)) || (res == nil && !retryError(err)) {
+			return res, nil, err
+		}
+		wait := backoff
+		if d, ok := retryAfter(res); ok && d > wait {
+			wait = d
+		}
+		backoff *= 2
+		log.Printf("%s: retry in %s", err, wait)
+		if err := sleep(ctx, wait); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// try sends a single request within the limits of the host.
+// The response body is read and closed.
+func (c *Client) try(ctx context.Context, rawurl string, h http.Header) (*http.Response, []byte, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	release, err := c.acquire(ctx, u.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawurl, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, body, nil
+}
+
+// retryError returns true for network errors, which may succeed with a later request.
+// Invalid urls and other errors building the request are returned immediately.
+func retryError(err error) bool {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		if ue.Op == "parse" {
+			return false
+		} else if ue.Timeout() {
+			return true
+		}
+		err = ue.Err
+	}
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// acquire waits until a request to host is allowed by MaxConns and Rate.
+// The returned function must be called after the request is done.
+func (c *Client) acquire(ctx context.Context, host string) (func(), error) {
+	if c.MaxConns <= 0 && c.Rate <= 0 {
+		return func() {}, nil
+	}
+	c.mu.Lock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]*hostLimit)
+	}
+	l, ok := c.hosts[host]
+	if !ok {
+		l = &hostLimit{}
+		if c.MaxConns > 0 {
+			l.conns = make(chan struct{}, c.MaxConns)
+		}
+		c.hosts[host] = l
+	}
+	c.mu.Unlock()
+
+	release := func() {}
+	if l.conns != nil {
+		select {
+		case l.conns <- struct{}{}:
+			release = func() { <-l.conns }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if c.Rate > 0 {
+		// Reserve the next free time slot and wait for it.
+		c.mu.Lock()
+		now := time.Now()
+		start := l.next
+		if start.Before(now) {
+			start = now
+		}
+		l.next = start.Add(time.Duration(float64(time.Second) / c.Rate))
+		c.mu.Unlock()
+		if err := sleep(ctx, start.Sub(now)); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// retryStatus returns true for responses, which may succeed if the request is repeated.
+func retryStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// retryAfter returns the duration requested by the Retry-After header.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res == nil {
+		return 0, false
+	}
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// sleep waits for the duration d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
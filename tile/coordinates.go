@@ -29,23 +29,20 @@ type LatLon struct {
 	Lon Degree // Longitude (lines around the equator and parallel to it): "[-180, 180]"
 }
 
-// XY converts d to XY for the given zoom level [0, 24].
+// XY converts d to XY for the given zoom level [0, 24] and tiles of TileSize pixels.
 func (d LatLon) XY(z int) (XY, error) {
+	return d.XYSize(z, TileSize)
+}
+
+// XYSize converts d to XY for the given zoom level and tiles of size x size pixels.
+func (d LatLon) XYSize(z, size int) (XY, error) {
 	if z < 0 || z > 24 {
 		return XY{}, ZoomRangeError
 	}
 	if d.Lat < MinLatitude(z) || d.Lat > MaxLatitude {
 		return XY{}, fmt.Errorf("latitude %s value cannot be represented by tile coordinates", d.Lat)
 	}
-	x := (float64(d.Lon) + 180) / 360 * two[z]
-	y := (1 - math.Log(math.Tan(d.Lat.Radians())+1/math.Cos(d.Lat.Radians()))/math.Pi) / 2 * two[z]
-	return XY{
-		X:  int(x),
-		Y:  int(y),
-		Z:  z,
-		XP: int(256 * (x - float64(int(x)))),
-		YP: int(256 * (y - float64(int(y)))),
-	}, nil
+	return d.World().XY(z, size), nil
 }
 
 func (d LatLon) String() string {
@@ -83,6 +80,55 @@ func (d1 LatLon) Distance(d2 LatLon) Meter {
 	return EarthRadius * Meter(math.Atan2(math.Sqrt(a*a+b*b), math.Sin(lat1)*math.Sin(lat2)+math.Cos(lat1)*math.Cos(lat2)*math.Cos(dLon)))
 }
 
+// Bearing returns the initial bearing on the great circle from d1 to d2.
+// Bearings are measured clockwise from north in the range [0°, 360°).
+func (d1 LatLon) Bearing(d2 LatLon) Degree {
+	lat1, lat2 := d1.Lat.Radians(), d2.Lat.Radians()
+	dLon := d2.Lon.Radians() - d1.Lon.Radians()
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return compass(degrees(math.Atan2(y, x)))
+}
+
+// FinalBearing returns the bearing on the great circle from d1 at the arrival at d2.
+func (d1 LatLon) FinalBearing(d2 LatLon) Degree {
+	return compass(d2.Bearing(d1) + 180)
+}
+
+// Destination returns the point reached from d after the distance along the great circle
+// starting with the initial bearing.
+func (d LatLon) Destination(bearing Degree, distance Meter) LatLon {
+	lat, lon := d.Lat.Radians(), d.Lon.Radians()
+	sinθ, cosθ := math.Sincos(bearing.Radians())
+	sinδ, cosδ := math.Sincos(float64(distance / EarthRadius))
+	lat2 := math.Asin(math.Sin(lat)*cosδ + math.Cos(lat)*sinδ*cosθ)
+	lon2 := lon + math.Atan2(sinθ*sinδ*math.Cos(lat), cosδ-math.Sin(lat)*math.Sin(lat2))
+	return LatLon{degrees(lat2), wrap180(degrees(lon2))}
+}
+
+// Intermediate returns the point at the fraction f of the great circle from d1 to d2.
+// It returns d1 for f = 0 and d2 for f = 1.
+// The great circle between antipodal points is not unique and the result is arbitrary.
+func (d1 LatLon) Intermediate(d2 LatLon, f float64) LatLon {
+	δ := float64(d1.Distance(d2) / EarthRadius)
+	if δ == 0 {
+		return d1
+	}
+	lat1, lon1 := d1.Lat.Radians(), d1.Lon.Radians()
+	lat2, lon2 := d2.Lat.Radians(), d2.Lon.Radians()
+	a := math.Sin((1-f)*δ) / math.Sin(δ)
+	b := math.Sin(f*δ) / math.Sin(δ)
+	x := a*math.Cos(lat1)*math.Cos(lon1) + b*math.Cos(lat2)*math.Cos(lon2)
+	y := a*math.Cos(lat1)*math.Sin(lon1) + b*math.Cos(lat2)*math.Sin(lon2)
+	z := a*math.Sin(lat1) + b*math.Sin(lat2)
+	return LatLon{degrees(math.Atan2(z, math.Hypot(x, y))), degrees(math.Atan2(y, x))}
+}
+
+// Midpoint returns the point half way on the great circle between d1 and d2.
+func (d1 LatLon) Midpoint(d2 LatLon) LatLon {
+	return d1.Intermediate(d2, 0.5)
+}
+
 // XY defines the tile coordinates with a zoom index [0,24].
 // The tile coordinate system does not have the same range as the spherical degrees.
 // Points north of MaxLatitude or south of MinLatitude(zoomLevel) cannot be represented.
@@ -90,8 +136,37 @@ func (d1 LatLon) Distance(d2 LatLon) Meter {
 // and 178.59375° for Z = 0.
 type XY struct {
 	X, Y   int // Tile index [0, 2^Z].
-	XP, YP int // Pixel offset to top left corner within the tile [0, 255].
+	XP, YP int // Pixel offset to top left corner within the tile [0, Size-1].
 	Z      int // Zoom index [0, 24].
+	Size   int // Tile edge length in pixels. The zero value means TileSize.
+}
+
+// TileSize is the default edge length of a tile in pixels.
+// Servers with other tile sizes implement Sizer.
+const TileSize = 256
+
+// Sizer is implemented by servers, which do not serve tiles with the default TileSize,
+// e.g. retina (@2x) tiles with 512 pixels.
+type Sizer interface {
+	TileSize() int
+}
+
+// SizeOf returns the tile size of the server s.
+func SizeOf(s Server) int {
+	if sz, ok := s.(Sizer); ok {
+		if n := sz.TileSize(); n > 0 {
+			return n
+		}
+	}
+	return TileSize
+}
+
+// size returns the tile size of xy.
+func (xy XY) size() int {
+	if xy.Size == 0 {
+		return TileSize
+	}
+	return xy.Size
 }
 
 // MaxLatitude is the maximal latitude, that a tile coordinate can represent
@@ -109,14 +184,13 @@ func MinLatitude(z int) Degree {
 // PixelSize calculates the edge length of a single pixel at XY in meters.
 // It uses the mean earth Radius instead of the equator length for the calculation.
 func (xy XY) PixelSize() Meter {
-	// 2 * pi * R    pi * R     |
-	// ---------- =  -------    | reduced by factor cos(lat)
-	// 256 * 2^z     2^(7+z)    |
+	// 2 * pi * R       |
+	// ------------     | reduced by factor cos(lat)
+	// size * 2^z       |
 	deg := xy.LatLon()
 	coslat := math.Cos(deg.Lat.Radians())
-	// This does not overflow for max zoom = 24.
 	checkZoom(xy.Z)
-	return EarthRadius * Meter(math.Pi*coslat/float64(uint(1)<<uint(7+xy.Z)))
+	return EarthRadius * Meter(2*math.Pi*coslat/(float64(xy.size())*two[xy.Z]))
 }
 
 func (xy XY) String() string {
@@ -125,13 +199,7 @@ func (xy XY) String() string {
 
 // Deg converts xy to LatLon for the given zoom level.
 func (xy XY) LatLon() LatLon {
-	x := float64(xy.X) + float64(xy.XP)/256
-	y := float64(xy.Y) + float64(xy.YP)/256
-	n := math.Pi - 2*math.Pi*y/two[xy.Z]
-	return LatLon{
-		Lat: Degree(180.0 / math.Pi * math.Atan(0.5*(math.Exp(n)-math.Exp(-n)))),
-		Lon: Degree(x/two[xy.Z]*360 - 180),
-	}
+	return xy.World().LatLon()
 }
 
 var ZoomRangeError = errors.New("zoom value is out of range [0, 24]")
@@ -73,7 +73,7 @@ func TestDistance(t *testing.T) {
 	}
 }
 
-func ExamplePixelSize() {
+func ExampleXY_PixelSize() {
 	l := 2 * math.Pi * EarthRadius / 256
 	var horizontalPixels uint64 = 256
 	var buf bytes.Buffer
@@ -123,3 +123,427 @@ func ExamplePixelSize() {
 	// 23  2147483648   0.018640527913380344m
 	// 24  4294967296   0.009320263956690172m
 }
+
+func TestXYSize(t *testing.T) {
+	ll := LatLon{49.87139, 8.65631}
+	for z := 0; z <= 20; z++ {
+		a, err := ll.XY(z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ll.XYSize(z, 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.X != b.X || a.Y != b.Y || b.XP/2 != a.XP || b.YP/2 != a.YP {
+			t.Fatalf("z=%d: %s and %s differ", z, a, b)
+		}
+		c := XY{X: a.X, Y: a.Y, Z: z, XP: 2 * a.XP, YP: 2 * a.YP, Size: 512} // same position as a
+		if s := 2 * c.PixelSize(); math.Abs(float64(s-a.PixelSize())) > 1e-9*float64(s) {
+			t.Fatalf("z=%d: pixel size %s is not half of %s", z, c.PixelSize(), a.PixelSize())
+		}
+		if d := b.LatLon().Distance(ll); d > 2*b.PixelSize() {
+			t.Fatalf("z=%d: back transform is off by %s", z, d)
+		}
+	}
+}
+
+func TestGeodesic(t *testing.T) {
+	dms := func(d, m, s float64) Degree { return Degree(math.Copysign(math.Abs(d)+m/60+s/3600, d)) }
+	near := func(name string, got, want, tol float64) {
+		if math.Abs(got-want) > tol {
+			t.Errorf("%s: got %.11f, want %.11f", name, got, want)
+		}
+	}
+
+	// Direct example from C. F. F. Karney, Algorithms for geodesics, J. Geodesy 87 (2013).
+	p2, azi2 := WGS84.Direct(LatLon{40, 0}, 30, 10e6)
+	near("direct lat", float64(p2.Lat), 41.79331020506, 1e-8)
+	near("direct lon", float64(p2.Lon), 137.84490004377, 1e-8)
+	near("direct azimuth", float64(azi2), 149.09016931807, 1e-8)
+	g, err := WGS84.Inverse(LatLon{40, 0}, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	near("inverse distance", float64(g.Distance), 10e6, 1e-3)
+	near("inverse azimuth1", float64(g.Azimuth1), 30, 1e-8)
+	near("inverse azimuth2", float64(g.Azimuth2), 149.09016931807, 1e-8)
+
+	// Flinders Peak to Buninyong on GRS80, Geoscience Australia, Geodetic Datum of Australia Technical Manual.
+	grs80 := Ellipsoid{A: 6378137, F: 1 / 298.257222101}
+	flinders := LatLon{-dms(37, 57, 3.72030), dms(144, 25, 29.52440)}
+	buninyong := LatLon{-dms(37, 39, 10.15610), dms(143, 55, 35.38390)}
+	g, err = grs80.Inverse(flinders, buninyong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	near("flinders distance", float64(g.Distance), 54972.271, 1e-3)
+	near("flinders azimuth", float64(g.Azimuth1), float64(dms(306, 52, 5.37)-360), 0.01/3600)
+	near("flinders back azimuth", float64(g.BackAzimuth()), float64(dms(127, 10, 25.07)), 0.01/3600)
+	p2, _ = grs80.Direct(flinders, g.Azimuth1, g.Distance)
+	near("flinders direct lat", float64(p2.Lat), float64(buninyong.Lat), 1e-9)
+	near("flinders direct lon", float64(p2.Lon), float64(buninyong.Lon), 1e-9)
+
+	// The ellipsoidal distance differs from the spherical distance by less than 0.5%.
+	for _, c := range [][2]string{{"los angeles", "new york"}, {"hamburg", "munich"}, {"new york", "london"}} {
+		a, b := Cities[c[0]], Cities[c[1]]
+		g, err := WGS84.Inverse(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := float64(g.Distance / a.Distance(b)); math.Abs(r-1) > 0.005 {
+			t.Errorf("%s -> %s: ellipsoidal/spherical distance ratio is %v", c[0], c[1], r)
+		}
+	}
+
+	if g, err := WGS84.Inverse(LatLon{10, 20}, LatLon{10, 20}); err != nil || g.Distance != 0 {
+		t.Errorf("coincident points: %v %v", g, err)
+	}
+	if _, err := WGS84.Inverse(LatLon{0, 0}, LatLon{0.5, 179.7}); err != NoConvergenceError {
+		t.Errorf("nearly antipodal points: expected NoConvergenceError, got %v", err)
+	}
+}
+
+func TestBearing(t *testing.T) {
+	dms := func(d, m, s float64) Degree { return Degree(math.Copysign(math.Abs(d)+m/60+s/3600, d)) }
+	near := func(name string, got, want Degree) {
+		if math.Abs(float64(got-want)) > 1.0/3600 {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+
+	// Land's End to John o' Groats.
+	a := LatLon{dms(50, 3, 59), -dms(5, 42, 53)}
+	b := LatLon{dms(58, 38, 38), -dms(3, 4, 12)}
+	if d := a.Distance(b); math.Abs(float64(d)-968.9e3) > 100 {
+		t.Errorf("distance: %v", d)
+	}
+	near("bearing", a.Bearing(b), dms(9, 7, 11))
+	near("final bearing", a.FinalBearing(b), dms(11, 16, 31))
+	m := a.Midpoint(b)
+	near("midpoint lat", m.Lat, dms(54, 21, 44))
+	near("midpoint lon", m.Lon, -dms(4, 31, 50))
+	if p := a.Intermediate(b, 0); p != a {
+		t.Errorf("intermediate 0: %v", p)
+	}
+	p := a.Intermediate(b, 1)
+	near("intermediate 1 lat", p.Lat, b.Lat)
+	near("intermediate 1 lon", p.Lon, b.Lon)
+	if d := a.Intermediate(b, 0.25).Distance(a); math.Abs(float64(d/a.Distance(b))-0.25) > 1e-9 {
+		t.Errorf("intermediate 0.25: distance is %v", d)
+	}
+
+	d := LatLon{dms(53, 19, 14), -dms(1, 43, 47)}.Destination(dms(96, 1, 18), 124.8e3)
+	near("destination lat", d.Lat, dms(53, 11, 18))
+	near("destination lon", d.Lon, dms(0, 8, 0))
+	near("bearing west", LatLon{0, 10}.Bearing(LatLon{0, 0}), 270)
+	near("destination across antimeridian", LatLon{0, 179}.Destination(90, EarthRadius*math.Pi/90).Lon, -179)
+
+	// Ellipsoidal: Flinders Peak to Buninyong, see TestGeodesic.
+	grs80 := Ellipsoid{A: 6378137, F: 1 / 298.257222101}
+	a = LatLon{-dms(37, 57, 3.72030), dms(144, 25, 29.52440)}
+	b = LatLon{-dms(37, 39, 10.15610), dms(143, 55, 35.38390)}
+	if bearing, err := grs80.Bearing(a, b); err != nil {
+		t.Error(err)
+	} else {
+		near("ellipsoidal bearing", bearing, dms(306, 52, 5.37))
+	}
+	if bearing, err := grs80.FinalBearing(a, b); err != nil {
+		t.Error(err)
+	} else {
+		near("ellipsoidal final bearing", bearing, dms(307, 10, 25.07))
+	}
+	p = grs80.Destination(a, dms(306, 52, 5.37), 54972.271)
+	near("ellipsoidal destination lat", p.Lat, b.Lat)
+	near("ellipsoidal destination lon", p.Lon, b.Lon)
+	m, err := grs80.Midpoint(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g1, _ := grs80.Inverse(a, m)
+	g2, _ := grs80.Inverse(m, b)
+	if math.Abs(float64(g1.Distance-g2.Distance)) > 1e-3 || math.Abs(float64(g1.Distance)-54972.271/2) > 1e-3 {
+		t.Errorf("ellipsoidal midpoint: distances %v %v", g1.Distance, g2.Distance)
+	}
+	if _, err := WGS84.Intermediate(LatLon{0, 0}, LatLon{0.5, 179.7}, 0.5); err != NoConvergenceError {
+		t.Errorf("nearly antipodal points: expected NoConvergenceError, got %v", err)
+	}
+}
+
+func TestBBox(t *testing.T) {
+	europe := BBox{LatLon{35, -10}, LatLon{60, 30}}
+	pacific := BBox{LatLon{-30, 150}, LatLon{30, -120}}
+	world := BBox{LatLon{-90, -180}, LatLon{90, 180}}
+
+	if b := BBoxOf(Cities["hamburg"], Cities["munich"], Cities["berlin"]); b.Min.Lat != Cities["munich"].Lat || b.Max.Lon != Cities["berlin"].Lon {
+		t.Errorf("BBoxOf: %v", b)
+	}
+	if b := BBoxCorners(europe.TopLeft(), europe.BottomRight()); b != europe {
+		t.Errorf("BBoxCorners: %v", b)
+	}
+	for _, tc := range []struct {
+		b    BBox
+		w    Degree
+		p    LatLon
+		in   bool
+		name string
+	}{
+		{europe, 40, Cities["berlin"], true, "europe"},
+		{europe, 40, Cities["new york"], false, "europe"},
+		{pacific, 90, LatLon{0, 180}, true, "pacific"},
+		{pacific, 90, LatLon{0, -150}, true, "pacific"},
+		{pacific, 90, LatLon{0, 0}, false, "pacific"},
+		{world, 360, LatLon{0, 0}, true, "world"},
+	} {
+		if w := tc.b.Width(); w != tc.w {
+			t.Errorf("%s: width %v != %v", tc.name, w, tc.w)
+		}
+		if in := tc.b.Contains(tc.p); in != tc.in {
+			t.Errorf("%s: contains %v: %v", tc.name, tc.p, in)
+		}
+	}
+
+	if u := europe.Union(BBox{LatLon{-40, 140}, LatLon{-10, 175}}); u.CrossesAntimeridian() || u.Min.Lon != -10 || u.Max.Lon != 175 || u.Min.Lat != -40 {
+		t.Errorf("union without antimeridian: %v", u)
+	}
+	if u := pacific.Union(BBox{LatLon{0, 100}, LatLon{10, 110}}); u.Min.Lon != 100 || u.Max.Lon != -120 {
+		t.Errorf("union with pacific: %v", u)
+	}
+	if u := pacific.Union(BBox{LatLon{0, -100}, LatLon{10, -90}}); u.Min.Lon != 150 || u.Max.Lon != -90 {
+		t.Errorf("union with pacific: %v", u)
+	}
+	if u := pacific.Union(BBox{LatLon{0, -100}, LatLon{10, 140}}); u.Min.Lon != -100 || u.Max.Lon != -120 {
+		t.Errorf("union with a gap of 20°: %v", u)
+	}
+	if u := pacific.Union(BBox{LatLon{0, -120}, LatLon{10, 150}}); u.Width() != 360 {
+		t.Errorf("union around the world: %v", u)
+	}
+
+	if r, ok := europe.Intersection(pacific); ok {
+		t.Errorf("intersection europe, pacific: %v", r)
+	}
+	if r, ok := pacific.Intersection(BBox{LatLon{10, 170}, LatLon{50, -170}}); !ok || r != (BBox{LatLon{10, 170}, LatLon{30, -170}}) {
+		t.Errorf("intersection across the antimeridian: %v %v", r, ok)
+	}
+	if r, ok := pacific.Intersection(BBox{LatLon{0, -130}, LatLon{10, 0}}); !ok || r != (BBox{LatLon{0, -130}, LatLon{10, -120}}) {
+		t.Errorf("intersection east of the antimeridian: %v %v", r, ok)
+	}
+	if r, ok := world.Intersection(pacific); !ok || r != pacific {
+		t.Errorf("intersection with the world: %v %v", r, ok)
+	}
+
+	hamburg := Cities["hamburg"]
+	b := BBoxOf(hamburg).Expand(10e3)
+	for _, bearing := range []Degree{0, 90, 180, 270} {
+		if p := hamburg.Destination(bearing, 9.9e3); !b.Contains(p) {
+			t.Errorf("expand: %v is outside of %v", p, b)
+		}
+		if p := hamburg.Destination(bearing, 10.1e3); b.Contains(p) {
+			t.Errorf("expand: %v is inside of %v", p, b)
+		}
+	}
+	if b := BBoxOf(LatLon{0, 179.9}).Expand(100e3); !b.CrossesAntimeridian() || !b.Contains(LatLon{0, -179.5}) {
+		t.Errorf("expand across the antimeridian: %v", b)
+	}
+	if b := BBoxOf(LatLon{89.5, 0}).Expand(100e3); b.Width() != 360 || b.Max.Lat != 90 {
+		t.Errorf("expand to the pole: %v", b)
+	}
+}
+
+func TestTileRange(t *testing.T) {
+	if _, err := (BBox{}).TileRange(25); err != ZoomRangeError {
+		t.Errorf("expected ZoomRangeError, got %v", err)
+	}
+	for z := 0; z < 4; z++ {
+		r, err := BBox{LatLon{-90, -180}, LatLon{90, 180}}.TileRange(z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Len() != NumTiles(z)*NumTiles(z) {
+			t.Errorf("world z=%d: %d tiles", z, r.Len())
+		}
+	}
+
+	// 2 tiles west and 1 tile east of the antimeridian, 2 rows at zoom level 3.
+	r, err := BBox{LatLon{-10, 100}, LatLon{10, -170}}.TileRange(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (TileRange{Z: 3, X0: 6, Y0: 3, X1: 8, Y1: 4}); r != want {
+		t.Fatalf("got %+v, want %+v", r, want)
+	}
+	var got []string
+	for xy := range r.All() {
+		if !r.Contains(xy.X, xy.Y) {
+			t.Errorf("%v is not contained", xy)
+		}
+		got = append(got, fmt.Sprintf("%d/%d", xy.X, xy.Y))
+	}
+	if s := fmt.Sprint(got); s != "[6/3 6/4 7/3 7/4 0/3 0/4]" {
+		t.Errorf("tiles: %s", s)
+	}
+	if r.Contains(1, 3) || r.Contains(5, 3) || r.Contains(6, 5) || !r.Contains(8, 3) {
+		t.Error("contains")
+	}
+	// Stopping the iteration early must not panic.
+	for range r.All() {
+		break
+	}
+
+	// Longitude 180° is the east edge of the last tile.
+	if r, _ := (BBox{LatLon{0, 180}, LatLon{0, 180}}).TileRange(2); r.X0 != 3 || r.X1 != 3 {
+		t.Errorf("lon 180: %+v", r)
+	}
+}
+
+func TestWorld(t *testing.T) {
+	if w := (LatLon{MaxLatitude, -180}).World(); math.Abs(w.X) > 1e-15 || math.Abs(w.Y) > 1e-15 {
+		t.Errorf("top left: %v", w)
+	}
+	if w := (LatLon{0, 0}).World(); w != (World{0.5, 0.5}) {
+		t.Errorf("center: %v", w)
+	}
+	if x, y := (World{0.5, 0.25}).Pixel(1, 256); x != 256 || y != 128 {
+		t.Errorf("pixel: %v %v", x, y)
+	}
+	if w := PixelWorld(1, 256, 256, 128); w != (World{0.5, 0.25}) {
+		t.Errorf("pixel world: %v", w)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		ll := LatLon{Degree(170*r.Float64() - 85), Degree(360*r.Float64() - 180)}
+		if b := ll.World().LatLon(); math.Abs(float64(b.Lat-ll.Lat)) > 1e-12 || math.Abs(float64(b.Lon-ll.Lon)) > 1e-12 {
+			t.Fatalf("%v: round trip returns %v", ll, b)
+		}
+
+		// The truncated tile coordinates agree with XYSize.
+		z := r.Intn(25)
+		xy, err := ll.XYSize(z, 512)
+		if err != nil {
+			continue
+		}
+		w := ll.World()
+		if x, y := w.Pixel(z, 512); int(x) != 512*xy.X+xy.XP || int(y) != 512*xy.Y+xy.YP {
+			t.Fatalf("%v z=%d: pixel %v,%v != %v", ll, z, x, y, xy)
+		}
+		f := w.Fixed()
+		if x, y := f.Tile(z); x != xy.X || y != xy.Y {
+			t.Fatalf("%v z=%d: tile %d/%d != %v", ll, z, x, y, xy)
+		}
+		if px, py := f.Pixel(z); int(px) != 256*xy.X+256*xy.XP/512 || int(py) != 256*xy.Y+256*xy.YP/512 {
+			t.Fatalf("%v z=%d: fixed pixel %d,%d != %v", ll, z, px, py, xy)
+		}
+
+		// Fixed-point coordinates round trip losslessly.
+		p := World32{r.Uint32(), r.Uint32()}
+		if q := p.LatLon().World32(); q != p {
+			t.Fatalf("%v: round trip returns %v", p, q)
+		}
+	}
+
+	// Tile corners round trip exactly.
+	if xy, _ := (LatLon{10, 135}).XY(3); xy.X != 7 {
+		t.Errorf("135°E is in tile 7, got %v", xy)
+	}
+	for z := 0; z <= 24; z++ {
+		n := NumTiles(z)
+		for i := 0; i < 1024 && i < n; i++ {
+			x := i * n / min(n, 1024)
+			for _, y := range []int{x, n - 1 - x} {
+				c := XY{X: x, Y: y, Z: z}
+				if b, err := c.LatLon().XY(z); err != nil || b.X != x || b.Y != y || b.XP != 0 || b.YP != 0 {
+					t.Fatalf("corner %d/%d/%d round trips to %v %v", z, x, y, b, err)
+				}
+			}
+		}
+	}
+
+	if f := (LatLon{0, 180}).World32(); f.X != 0 {
+		t.Errorf("fixed antimeridian wraps to 0: %v", f)
+	}
+	if f := (LatLon{90, 0}).World32(); f.Y != 0 {
+		t.Errorf("fixed north pole: %v", f)
+	}
+	if f := (LatLon{-90, 0}).World32(); f.Y != math.MaxUint32 {
+		t.Errorf("fixed south pole: %v", f)
+	}
+}
+
+func TestProjection(t *testing.T) {
+	near := func(name string, got, want, tol float64) {
+		if math.Abs(got-want) > tol {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+
+	// Web mercator in meters.
+	x, y := WebMercator{}.Project(LatLon{MaxLatitude, 180})
+	near("web mercator x", x, 20037508.342789244, 1e-6)
+	near("web mercator y", y, 20037508.342789244, 1e-6)
+	x, y = WebMercator{}.Project(Cities["hamburg"])
+	ll := WebMercator{}.Unproject(x, y)
+	near("web mercator lat", float64(ll.Lat), float64(Cities["hamburg"].Lat), 1e-12)
+	near("web mercator lon", float64(ll.Lon), float64(Cities["hamburg"].Lon), 1e-12)
+
+	// Plate carrée tiles: 2 tiles at zoom level 0.
+	w := ProjectWorld(PlateCarree{}, LatLon{-45, 90})
+	if w != (World{1.5, 0.75}) {
+		t.Errorf("plate carrée world: %v", w)
+	}
+	if xy := w.XY(1, 256); xy.X != 3 || xy.Y != 1 || xy.XP != 0 || xy.YP != 128 {
+		t.Errorf("plate carrée xy: %v", xy)
+	}
+	if ll := UnprojectWorld(PlateCarree{}, World{0.25, 0.5}); ll != (LatLon{0, -135}) {
+		t.Errorf("plate carrée unproject: %v", ll)
+	}
+
+	// UTM reference points.
+	for _, tc := range []struct {
+		name string
+		ll   LatLon
+		zone UTM
+		e, n float64
+	}{
+		{"CN Tower", LatLon{43.642567, -79.387139}, UTM{Zone: 17}, 630084, 4833439},
+		{"Eiffel Tower", LatLon{48.8582, 2.2945}, UTM{Zone: 31}, 448252, 5411933},
+	} {
+		u := UTMZone(tc.ll)
+		if u != tc.zone {
+			t.Errorf("%s: zone %v != %v", tc.name, u, tc.zone)
+		}
+		e, n := u.Project(tc.ll)
+		near(tc.name+" easting", e, tc.e, 1)
+		near(tc.name+" northing", n, tc.n, 1)
+		ll := u.Unproject(e, n)
+		near(tc.name+" lat", float64(ll.Lat), float64(tc.ll.Lat), 1e-8)
+		near(tc.name+" lon", float64(ll.Lon), float64(tc.ll.Lon), 1e-8)
+	}
+
+	// The southern hemisphere is mirrored at the equator with the false northing of 10000km.
+	south := LatLon{-48.8582, 2.2945}
+	e, n := UTMZone(south).Project(south)
+	near("south easting", e, 448252, 1)
+	near("south northing", n, 10000e3-5411933, 1)
+	ll = UTMZone(south).Unproject(e, n)
+	near("south lat", float64(ll.Lat), float64(south.Lat), 1e-8)
+
+	// The scale on the central meridian is 0.9996.
+	u := UTM{Zone: 32}
+	_, n0 := u.Project(LatLon{50, 9})
+	_, n1 := u.Project(LatLon{50.001, 9})
+	g, _ := WGS84.Inverse(LatLon{50, 9}, LatLon{50.001, 9})
+	near("scale", (n1-n0)/float64(g.Distance), 0.9996, 1e-6)
+
+	for _, tc := range []struct {
+		ll   LatLon
+		zone int
+	}{
+		{LatLon{60, 5}, 32}, {LatLon{60, 2}, 31}, {LatLon{78, 8}, 31}, {LatLon{78, 10}, 33},
+		{LatLon{78, 25}, 35}, {LatLon{78, 40}, 37}, {LatLon{0, -180}, 1}, {LatLon{0, 180}, 60},
+	} {
+		if u := UTMZone(tc.ll); u.Zone != tc.zone {
+			t.Errorf("%v: zone %d != %d", tc.ll, u.Zone, tc.zone)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package tile
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validity stores the HTTP cache validators and the expiry time of a tile.
+// It is recorded by CombinedServer for tiles written to the LocalServer,
+// and used to revalidate expired tiles with a conditional request.
+type Validity struct {
+	ETag         string
+	LastModified string
+	Expires      time.Time     // The zero value means the tile never expires.
+	Lifetime     time.Duration // Freshness lifetime, kept for a 304 response without expiry headers.
+}
+
+// Expired returns true, if the tile should be revalidated at time now.
+func (v Validity) Expired(now time.Time) bool {
+	return !v.Expires.IsZero() && now.After(v.Expires)
+}
+
+// ConditionalServer is a remote Server, which supports conditional requests.
+// GetIfModified sends the validators of v and returns a nil Tile, if the tile is not modified.
+// The returned Validity is updated from the response.
+type ConditionalServer interface {
+	GetIfModified(ctx context.Context, z, x, y int, v Validity) (Tile, Validity, error)
+}
+
+// GetIfModified requests the tile conditionally, see ConditionalServer.
+func (s HttpServer) GetIfModified(ctx context.Context, z, x, y int, v Validity) (Tile, Validity, error) {
+	t, _, v, err := s.getRaw(ctx, z, x, y, v)
+	return t, v, err
+}
+
+func (s HttpServer) getRaw(ctx context.Context, z, x, y int, v Validity) (Tile, []byte, Validity, error) {
+	url, err := s.URL(z, x, y)
+	if err != nil {
+		return nil, nil, v, err
+	}
+	t, b, v, err := DefaultClient.getTile(ctx, url, v)
+	if err != nil {
+		return nil, nil, v, err
+	}
+	return t, b, v, checkSize(t, TileSize)
+}
+
+// GetIfModified requests the tile conditionally, see ConditionalServer.
+func (s *TemplateServer) GetIfModified(ctx context.Context, z, x, y int, v Validity) (Tile, Validity, error) {
+	t, _, v, err := s.getRaw(ctx, z, x, y, v)
+	return t, v, err
+}
+
+func (s *TemplateServer) getRaw(ctx context.Context, z, x, y int, v Validity) (Tile, []byte, Validity, error) {
+	url, err := s.URL(z, x, y)
+	if err != nil {
+		return nil, nil, v, err
+	}
+	t, b, v, err := s.client().getTile(ctx, url, v)
+	if err != nil {
+		return nil, nil, v, err
+	}
+	return t, b, v, checkSize(t, s.TileSize())
+}
+
+// GetTileIfModified requests a tile from url with the validators from v.
+// It returns a nil Tile, if the server responds with 304 Not Modified.
+func (c *Client) GetTileIfModified(ctx context.Context, url string, v Validity) (Tile, Validity, error) {
+	t, _, v, err := c.getTile(ctx, url, v)
+	return t, v, err
+}
+
+// getTile is GetTileIfModified, which also returns the encoded tile as received.
+func (c *Client) getTile(ctx context.Context, url string, v Validity) (Tile, []byte, Validity, error) {
+	h := make(http.Header)
+	if v.ETag != "" {
+		h.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		h.Set("If-Modified-Since", v.LastModified)
+	}
+	log.Print("GET ", url)
+	res, body, err := c.get(ctx, url, h)
+	if err != nil {
+		return nil, nil, v, err
+	}
+	if res.StatusCode == http.StatusNotModified {
+		return nil, nil, v.update(res), nil
+	}
+	if tile, _, err := Decode(bytes.NewReader(body)); err != nil {
+		return nil, nil, v, fmt.Errorf("tile server did not return a valid image (Content-Type: %s): %s", res.Header.Get("Content-Type"), err)
+	} else {
+		return tile, body, Validity{}.update(res), nil
+	}
+}
+
+// update returns v with the validators and the expiry time from the response headers.
+// Validators missing in the response are kept.
+// A response without Cache-Control max-age or Expires extends the previous lifetime,
+// as a 304 response updates the stored freshness (RFC 7234 4.3.4).
+func (v Validity) update(res *http.Response) Validity {
+	if s := res.Header.Get("ETag"); s != "" {
+		v.ETag = s
+	}
+	if s := res.Header.Get("Last-Modified"); s != "" {
+		v.LastModified = s
+	}
+
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	for _, s := range strings.Split(res.Header.Get("Cache-Control"), ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "no-cache" || s == "no-store" {
+			v.Expires, v.Lifetime = date, 0
+			return v
+		} else if strings.HasPrefix(s, "max-age=") {
+			if n, err := strconv.Atoi(s[8:]); err == nil {
+				age, _ := strconv.Atoi(res.Header.Get("Age"))
+				v.Lifetime = time.Duration(n) * time.Second
+				v.Expires = date.Add(v.Lifetime - time.Duration(age)*time.Second)
+				return v
+			}
+		}
+	}
+	if t, err := http.ParseTime(res.Header.Get("Expires")); err == nil {
+		v.Expires, v.Lifetime = t, t.Sub(date)
+	} else if v.Lifetime > 0 {
+		v.Expires = date.Add(v.Lifetime)
+	} else {
+		v.Expires = time.Time{}
+	}
+	return v
+}
+
+// ValidityStore is a Store, which can record the Validity of it's tiles.
+// It is implemented by LocalServer and FileServer.
+type ValidityStore interface {
+	Store
+	Validity(z, x, y int) (Validity, error)
+	SetValidity(z, x, y int, v Validity) error
+}
+
+// Validity reads the validity information for a tile, that has been written with SetValidity.
+// It returns the zero Validity, if there is none.
+func (l LocalServer) Validity(z, x, y int) (Validity, error) {
+	return l.files().Validity(z, x, y)
+}
+
+// SetValidity stores the validity information for a tile next to it as z/x/y.http,
+// see FileServer.SetValidity.
+func (l LocalServer) SetValidity(z, x, y int, v Validity) error {
+	return l.files().SetValidity(z, x, y, v)
+}
+
+// Validity reads the validity information for a tile, that has been written with SetValidity.
+// It returns the zero Validity, if there is none.
+func (f FileServer) Validity(z, x, y int) (Validity, error) {
+	var v Validity
+	r, err := os.Open(f.file(z, x, y, ".http"))
+	if os.IsNotExist(err) {
+		return v, nil
+	} else if err != nil {
+		return v, err
+	}
+	defer r.Close()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), ": ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "ETag":
+			v.ETag = kv[1]
+		case "Last-Modified":
+			v.LastModified = kv[1]
+		case "Expires":
+			if t, err := http.ParseTime(kv[1]); err == nil {
+				v.Expires = t
+			}
+		case "Max-Age":
+			if n, err := strconv.Atoi(kv[1]); err == nil {
+				v.Lifetime = time.Duration(n) * time.Second
+			}
+		}
+	}
+	return v, s.Err()
+}
+
+// SetValidity stores the validity information for a tile next to it as z/x/y.http.
+// No file is written for the zero Validity, and an existing one is removed.
+func (f FileServer) SetValidity(z, x, y int, v Validity) error {
+	file := f.file(z, x, y, ".http")
+	if v == (Validity{}) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	if v.ETag != "" {
+		fmt.Fprintf(&buf, "ETag: %s\n", v.ETag)
+	}
+	if v.LastModified != "" {
+		fmt.Fprintf(&buf, "Last-Modified: %s\n", v.LastModified)
+	}
+	if !v.Expires.IsZero() {
+		fmt.Fprintf(&buf, "Expires: %s\n", v.Expires.UTC().Format(http.TimeFormat))
+	}
+	if v.Lifetime > 0 {
+		fmt.Fprintf(&buf, "Max-Age: %d\n", int64(v.Lifetime/time.Second))
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
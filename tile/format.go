@@ -0,0 +1,144 @@
+package tile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	_ "golang.org/x/image/webp" // register the webp decoder
+)
+
+// Format is an image encoding of tiles.
+// The values are the format names used by image.Decode.
+type Format string
+
+const (
+	PNG  Format = "png"
+	JPEG Format = "jpeg"
+	WebP Format = "webp" // WebP tiles can be decoded, but not encoded.
+)
+
+// Ext returns the default file extension for the format including the dot.
+func (f Format) Ext() string {
+	switch f {
+	case JPEG:
+		return ".jpg"
+	case "":
+		return ".png"
+	}
+	return "." + string(f)
+}
+
+// Encode writes the tile in the format f to w.
+// The quality [1, 100] is used for JPEG, 0 means jpeg.DefaultQuality.
+// The zero Format is PNG.
+func (f Format) Encode(w io.Writer, t Tile, quality int) error {
+	switch f {
+	case PNG, "":
+		return png.Encode(w, t)
+	case JPEG:
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, t, &jpeg.Options{Quality: quality})
+	}
+	return fmt.Errorf("cannot encode tiles as %s", string(f))
+}
+
+// Decode returns a Tile from an image read from r.
+// The format is detected by it's magic bytes, supported are png, jpeg and webp.
+// The image must be square, but it may have any size.
+func Decode(r io.Reader) (Tile, Format, error) {
+	img, name, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+	b := img.Bounds()
+	if b.Dx() != b.Dy() || b.Dx() == 0 {
+		return nil, "", fmt.Errorf("%s tile size %dx%d is not square", name, b.Dx(), b.Dy())
+	}
+	if t, ok := img.(draw.Image); ok {
+		return t, Format(name), nil
+	}
+	// JPEG and lossy WebP decode to YCbCr, which cannot be drawn on.
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba, Format(name), nil
+}
+
+// FileServer is a static tile file system on disk like LocalServer,
+// with a configurable image format.
+// Tiles are stored in Dir/z/x/y.Ext.
+//
+// Example for a large cache of satellite imagery:
+//
+//	FileServer{Dir: "path/to/tiles", Format: JPEG, Quality: 85}
+type FileServer struct {
+	Dir     string
+	Format  Format // Encoding used by Add. The zero value means PNG.
+	Ext     string // File extension including the dot. If empty, it is Format.Ext().
+	Quality int    // JPEG quality [1, 100], 0 means jpeg.DefaultQuality.
+}
+
+// Get returns the tile from disk from the path Dir/z/x/y.Ext.
+// The image format of the file is detected by it's content, not by the extension.
+func (f FileServer) Get(z, x, y int) (Tile, error) {
+	return f.GetContext(context.Background(), z, x, y)
+}
+
+// GetContext returns the tile from disk, if ctx is not done.
+func (f FileServer) GetContext(ctx context.Context, z, x, y int) (Tile, error) {
+	t, _, _, err := f.getRaw(ctx, z, x, y, Validity{})
+	return t, err
+}
+
+func (f FileServer) getRaw(ctx context.Context, z, x, y int, _ Validity) (Tile, []byte, Validity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, Validity{}, err
+	}
+	b, err := os.ReadFile(f.file(z, x, y, f.ext()))
+	if err != nil {
+		return nil, nil, Validity{}, err
+	}
+	t, _, err := Decode(bytes.NewReader(b))
+	return t, b, Validity{}, err
+}
+
+// Add writes the tile to disk in the configured format.
+// It overwrites any existing file.
+// The tile is written to a temporary file first, which is renamed to z/x/y.Ext,
+// so readers never see a partially written tile.
+func (f FileServer) Add(z, x, y int, t Tile) error {
+	if f.Dir == "" {
+		return errors.New("the local tile server path is unset")
+	}
+	file := f.file(z, x, y, f.ext())
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, func(w io.Writer) error {
+		return f.Format.Encode(w, t, f.Quality)
+	})
+}
+
+func (f FileServer) ext() string {
+	if f.Ext == "" {
+		return f.Format.Ext()
+	}
+	return f.Ext
+}
+
+// file returns the path Dir/z/x/y.ext.
+func (f FileServer) file(z, x, y int, ext string) string {
+	x, y = normalizeTile(z, x, y)
+	return filepath.Join(f.Dir, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+ext)
+}
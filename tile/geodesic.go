@@ -0,0 +1,204 @@
+package tile
+
+import (
+	"errors"
+	"math"
+)
+
+// Ellipsoid is a rotational ellipsoid defined by the semi-major axis A and the flattening F.
+type Ellipsoid struct {
+	A Meter
+	F float64
+}
+
+// WGS84 is the reference ellipsoid of the World Geodetic System 1984, used by GPS.
+var WGS84 = Ellipsoid{A: 6378137, F: 1 / 298.257223563}
+
+// Geodesic is the shortest path between two points on an ellipsoid.
+// Azimuths are measured clockwise from north in the range (-180°, 180°].
+type Geodesic struct {
+	Distance Meter
+	Azimuth1 Degree // Forward azimuth at the first point.
+	Azimuth2 Degree // Forward azimuth at the second point, in the direction away from the first point.
+}
+
+// BackAzimuth returns the azimuth at the second point pointing back to the first point.
+func (g Geodesic) BackAzimuth() Degree {
+	return wrap180(g.Azimuth2 + 180)
+}
+
+// NoConvergenceError is returned by Ellipsoid.Inverse for nearly antipodal points,
+// for which the Vincenty formula does not converge.
+var NoConvergenceError = errors.New("geodesic: vincenty formula does not converge for nearly antipodal points")
+
+// Inverse solves the inverse geodesic problem: it returns the geodesic between the points p1 and p2.
+// The calculation is done using the Vincenty formula, which is accurate to about 0.5 mm.
+// It returns NoConvergenceError for nearly antipodal points.
+func (e Ellipsoid) Inverse(p1, p2 LatLon) (Geodesic, error) {
+	f, a := e.F, float64(e.A)
+	b := (1 - f) * a
+	L := p2.Lon.Radians() - p1.Lon.Radians()
+	sinU1, cosU1 := reducedLatitude(p1.Lat, f)
+	sinU2, cosU2 := reducedLatitude(p2.Lat, f)
+
+	λ := L
+	var sinλ, cosλ, sinσ, cosσ, σ, cosSqα, cos2σm float64
+	antipodal := math.Abs(L) > math.Pi/2 || math.Abs(p2.Lat.Radians()-p1.Lat.Radians()) > math.Pi/2
+	converged := false
+	for i := 0; i < 1000; i++ {
+		sinλ, cosλ = math.Sincos(λ)
+		sinσ = math.Hypot(cosU2*sinλ, cosU1*sinU2-sinU1*cosU2*cosλ)
+		if sinσ == 0 {
+			return Geodesic{}, nil // coincident points
+		}
+		cosσ = sinU1*sinU2 + cosU1*cosU2*cosλ
+		σ = math.Atan2(sinσ, cosσ)
+		sinα := cosU1 * cosU2 * sinλ / sinσ
+		cosSqα = 1 - sinα*sinα
+		cos2σm = 0 // equatorial line
+		if cosSqα != 0 {
+			cos2σm = cosσ - 2*sinU1*sinU2/cosSqα
+		}
+		C := f / 16 * cosSqα * (4 + f*(4-3*cosSqα))
+		λp := λ
+		λ = L + (1-C)*f*sinα*(σ+C*sinσ*(cos2σm+C*cosσ*(-1+2*cos2σm*cos2σm)))
+		check := math.Abs(λ)
+		if antipodal {
+			check -= math.Pi
+		}
+		if check > math.Pi {
+			break
+		}
+		if math.Abs(λ-λp) <= 1e-12 {
+			converged = true
+			break
+		}
+	}
+	if !converged {
+		return Geodesic{}, NoConvergenceError
+	}
+
+	A, B := vincentyAB(cosSqα * (a*a - b*b) / (b * b))
+	Δσ := vincentyΔσ(B, sinσ, cosσ, cos2σm)
+	return Geodesic{
+		Distance: Meter(b * A * (σ - Δσ)),
+		Azimuth1: wrap180(degrees(math.Atan2(cosU2*sinλ, cosU1*sinU2-sinU1*cosU2*cosλ))),
+		Azimuth2: wrap180(degrees(math.Atan2(cosU1*sinλ, -sinU1*cosU2+cosU1*sinU2*cosλ))),
+	}, nil
+}
+
+// Direct solves the direct geodesic problem: it returns the point at the distance s from p
+// along the geodesic starting with the given azimuth, and the forward azimuth at that point.
+// The calculation is done using the Vincenty formula.
+func (e Ellipsoid) Direct(p LatLon, azimuth Degree, s Meter) (LatLon, Degree) {
+	f, a := e.F, float64(e.A)
+	b := (1 - f) * a
+	sinα1, cosα1 := math.Sincos(azimuth.Radians())
+	sinU1, cosU1 := reducedLatitude(p.Lat, f)
+
+	σ1 := math.Atan2(sinU1/cosU1, cosα1)
+	sinα := cosU1 * sinα1
+	cosSqα := 1 - sinα*sinα
+	A, B := vincentyAB(cosSqα * (a*a - b*b) / (b * b))
+
+	σ := float64(s) / (b * A)
+	var sinσ, cosσ, cos2σm float64
+	for i := 0; i < 100; i++ {
+		cos2σm = math.Cos(2*σ1 + σ)
+		sinσ, cosσ = math.Sincos(σ)
+		σp := σ
+		σ = float64(s)/(b*A) + vincentyΔσ(B, sinσ, cosσ, cos2σm)
+		if math.Abs(σ-σp) <= 1e-12 {
+			break
+		}
+	}
+	cos2σm = math.Cos(2*σ1 + σ)
+	sinσ, cosσ = math.Sincos(σ)
+
+	x := sinU1*sinσ - cosU1*cosσ*cosα1
+	φ2 := math.Atan2(sinU1*cosσ+cosU1*sinσ*cosα1, (1-f)*math.Hypot(sinα, x))
+	λ := math.Atan2(sinσ*sinα1, cosU1*cosσ-sinU1*sinσ*cosα1)
+	C := f / 16 * cosSqα * (4 + f*(4-3*cosSqα))
+	L := λ - (1-C)*f*sinα*(σ+C*sinσ*(cos2σm+C*cosσ*(-1+2*cos2σm*cos2σm)))
+	return LatLon{
+		Lat: degrees(φ2),
+		Lon: wrap180(p.Lon + degrees(L)),
+	}, wrap180(degrees(math.Atan2(sinα, -x)))
+}
+
+// reducedLatitude returns sin and cos of the reduced latitude on an ellipsoid with flattening f.
+func reducedLatitude(lat Degree, f float64) (sinU, cosU float64) {
+	sinφ, cosφ := math.Sincos(lat.Radians())
+	return math.Sincos(math.Atan2((1-f)*sinφ, cosφ))
+}
+
+// vincentyAB returns the coefficients A and B of the Vincenty formula for u².
+func vincentyAB(uSq float64) (A, B float64) {
+	A = 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	B = uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+	return A, B
+}
+
+func vincentyΔσ(B, sinσ, cosσ, cos2σm float64) float64 {
+	return B * sinσ * (cos2σm + B/4*(cosσ*(-1+2*cos2σm*cos2σm)-B/6*cos2σm*(-3+4*sinσ*sinσ)*(-3+4*cos2σm*cos2σm)))
+}
+
+func degrees(rad float64) Degree {
+	return Degree(rad * 180 / math.Pi)
+}
+
+// compass returns the angle d in the range [0°, 360°).
+func compass(d Degree) Degree {
+	d = Degree(math.Mod(float64(d), 360))
+	if d < 0 {
+		d += 360
+	}
+	if d == 360 {
+		return 0
+	}
+	return d
+}
+
+// wrap180 returns the angle d in the range (-180°, 180°].
+func wrap180(d Degree) Degree {
+	d = Degree(math.Mod(float64(d), 360))
+	if d <= -180 {
+		d += 360
+	} else if d > 180 {
+		d -= 360
+	}
+	return d
+}
+
+// Bearing returns the initial bearing of the geodesic from p1 to p2 in the range [0°, 360°).
+func (e Ellipsoid) Bearing(p1, p2 LatLon) (Degree, error) {
+	g, err := e.Inverse(p1, p2)
+	return compass(g.Azimuth1), err
+}
+
+// FinalBearing returns the bearing of the geodesic from p1 at the arrival at p2 in the range [0°, 360°).
+func (e Ellipsoid) FinalBearing(p1, p2 LatLon) (Degree, error) {
+	g, err := e.Inverse(p1, p2)
+	return compass(g.Azimuth2), err
+}
+
+// Destination returns the point reached from p after the distance along the geodesic
+// starting with the initial bearing.
+func (e Ellipsoid) Destination(p LatLon, bearing Degree, distance Meter) LatLon {
+	p2, _ := e.Direct(p, bearing, distance)
+	return p2
+}
+
+// Intermediate returns the point at the fraction f of the geodesic from p1 to p2.
+func (e Ellipsoid) Intermediate(p1, p2 LatLon, f float64) (LatLon, error) {
+	g, err := e.Inverse(p1, p2)
+	if err != nil {
+		return LatLon{}, err
+	}
+	return e.Destination(p1, g.Azimuth1, Meter(f)*g.Distance), nil
+}
+
+// Midpoint returns the point half way on the geodesic between p1 and p2.
+func (e Ellipsoid) Midpoint(p1, p2 LatLon) (LatLon, error) {
+	return e.Intermediate(p1, p2, 0.5)
+}
@@ -10,6 +10,7 @@ import (
 // Mandelbrot is a TileServer which renders an image of the Mandelbrot set.
 type Mandelbrot struct {
 	Palette color.Palette
+	Size    int // Tile size in pixels, 0 means TileSize.
 }
 
 // Get returns a tile for the given tile coordinates.
@@ -35,18 +36,27 @@ func (m Mandelbrot) Get(z, x, y int) (Tile, error) {
 	}
 
 	// For full scale (z=0), let both real and imaginary part range from -1 to 1.
+	n := m.TileSize()
 	c0 := complex(-1, -1)
-	scale := 1 / (128 * two[z])
+	scale := 2 / (float64(n) * two[z])
 
 	var c complex128
-	im := image.NewRGBA(image.Rect(0, 0, 256, 256))
-	i0 := x * 256
-	k0 := y * 256
-	for i := 0; i < 256; i++ {
-		for k := 0; k < 256; k++ {
+	im := image.NewRGBA(image.Rect(0, 0, n, n))
+	i0 := x * n
+	k0 := y * n
+	for i := 0; i < n; i++ {
+		for k := 0; k < n; k++ {
 			c = c0 + complex(scale*float64(i+i0), scale*float64(k+k0))
 			im.Set(i, k, mandelbrot(c))
 		}
 	}
 	return im, nil
 }
+
+// TileSize returns the tile size of m.
+func (m Mandelbrot) TileSize() int {
+	if m.Size == 0 {
+		return TileSize
+	}
+	return m.Size
+}
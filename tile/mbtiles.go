@@ -0,0 +1,256 @@
+package tile
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SQLDriver is the database/sql driver name used to open sqlite files.
+// The package does not register a driver, the program has to import one, e.g.
+//
+//	import _ "modernc.org/sqlite"
+var SQLDriver = "sqlite"
+
+// MBTiles is a tile Server backed by an MBTiles file, which is a sqlite database.
+// See https://github.com/mapbox/mbtiles-spec/blob/master/1.3/spec.md
+//
+// MBTiles uses TMS rows, that are flipped in y compared to the tile numbers of a Server.
+// This is handled by Get and Add.
+type MBTiles struct {
+	Format  Format // Encoding used by Add, it is initialized from the metadata.
+	Quality int    // JPEG quality [1, 100], 0 means jpeg.DefaultQuality.
+	db      *sql.DB
+}
+
+// MBTilesMetadata is the content of the metadata table.
+type MBTilesMetadata struct {
+	Name        string
+	Format      string     // png, jpg, webp or pbf
+	Bounds      [4]float64 // west, south, east, north in degrees
+	MinZoom     int
+	MaxZoom     int
+	Attribution string
+	Description string
+	Other       map[string]string // all other values
+}
+
+// OpenMBTiles opens or creates an MBTiles file.
+// The tables are created if they do not exist.
+// A tile source, that must exist, is opened with OpenMBTilesReadOnly.
+func OpenMBTiles(file string) (*MBTiles, error) {
+	db, err := sql.Open(SQLDriver, file)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // sqlite allows only a single writer.
+	// Tilesets from other tools may define tiles as a view, which is left as it is.
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name='tiles'`).Scan(&n); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS metadata (name text, value text)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if n == 0 {
+		for _, s := range []string{
+			`CREATE TABLE tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob)`,
+			`CREATE UNIQUE INDEX tile_index on tiles (zoom_level, tile_column, tile_row)`,
+		} {
+			if _, err := db.Exec(s); err != nil {
+				db.Close()
+				return nil, fmt.Errorf("%s: %s", file, err)
+			}
+		}
+	}
+	return newMBTiles(file, db)
+}
+
+// OpenMBTilesReadOnly opens an existing MBTiles file as a tile source.
+// It returns an error, if the file does not exist or has no tiles table.
+// Add fails for a read-only file.
+func OpenMBTilesReadOnly(file string) (*MBTiles, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(SQLDriver, "file:"+file+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name='tiles'`).Scan(&n); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %s", file, err)
+	} else if n == 0 {
+		db.Close()
+		return nil, fmt.Errorf("%s: no tiles table", file)
+	}
+	return newMBTiles(file, db)
+}
+
+// newMBTiles returns the MBTiles for db with the format from the metadata.
+func newMBTiles(file string, db *sql.DB) (*MBTiles, error) {
+	m := &MBTiles{db: db}
+	if md, err := m.Metadata(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %s", file, err)
+	} else if md.Format == "jpg" {
+		m.Format = JPEG
+	} else if md.Format != "" {
+		m.Format = Format(md.Format)
+	}
+	return m, nil
+}
+
+// Close closes the database.
+func (m *MBTiles) Close() error {
+	return m.db.Close()
+}
+
+// Get returns the tile from the database.
+// It returns an error wrapping os.ErrNotExist, if the tile is not present.
+func (m *MBTiles) Get(z, x, y int) (Tile, error) {
+	return m.GetContext(context.Background(), z, x, y)
+}
+
+// GetContext returns the tile from the database with a context.
+func (m *MBTiles) GetContext(ctx context.Context, z, x, y int) (Tile, error) {
+	t, _, _, err := m.getRaw(ctx, z, x, y, Validity{})
+	return t, err
+}
+
+func (m *MBTiles) getRaw(ctx context.Context, z, x, y int, _ Validity) (Tile, []byte, Validity, error) {
+	x, y = normalizeTile(z, x, y)
+	var b []byte
+	err := m.db.QueryRowContext(ctx, `SELECT tile_data FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=?`, z, x, tmsRow(z, y)).Scan(&b)
+	if err == sql.ErrNoRows {
+		return nil, nil, Validity{}, fmt.Errorf("mbtiles: tile %d/%d/%d: %w", z, x, y, os.ErrNotExist)
+	} else if err != nil {
+		return nil, nil, Validity{}, err
+	}
+	t, _, err := Decode(bytes.NewReader(b))
+	return t, b, Validity{}, err
+}
+
+// Add encodes the tile with the configured format and writes it to the database.
+// It overwrites any existing tile.
+func (m *MBTiles) Add(z, x, y int, t Tile) error {
+	x, y = normalizeTile(z, x, y)
+	var buf bytes.Buffer
+	if err := m.Format.Encode(&buf, t, m.Quality); err != nil {
+		return err
+	}
+	_, err := m.db.Exec(`INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)`, z, x, tmsRow(z, y), buf.Bytes())
+	return err
+}
+
+// Metadata reads the metadata table.
+func (m *MBTiles) Metadata() (MBTilesMetadata, error) {
+	var md MBTilesMetadata
+	rows, err := m.db.Query(`SELECT name, value FROM metadata`)
+	if err != nil {
+		return md, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return md, err
+		}
+		switch name {
+		case "name":
+			md.Name = value
+		case "format":
+			md.Format = value
+		case "bounds":
+			v := strings.Split(value, ",")
+			if len(v) != 4 {
+				return md, fmt.Errorf("mbtiles: bounds: %q", value)
+			}
+			for i := range v {
+				if md.Bounds[i], err = strconv.ParseFloat(strings.TrimSpace(v[i]), 64); err != nil {
+					return md, fmt.Errorf("mbtiles: bounds: %s", err)
+				}
+			}
+		case "minzoom":
+			md.MinZoom, err = strconv.Atoi(value)
+		case "maxzoom":
+			md.MaxZoom, err = strconv.Atoi(value)
+		case "attribution":
+			md.Attribution = value
+		case "description":
+			md.Description = value
+		default:
+			if md.Other == nil {
+				md.Other = make(map[string]string)
+			}
+			md.Other[name] = value
+		}
+		if err != nil {
+			return md, fmt.Errorf("mbtiles: %s: %s", name, err)
+		}
+	}
+	return md, rows.Err()
+}
+
+// SetMetadata replaces the metadata table.
+// The tile format is stored as Format, if it is empty.
+func (m *MBTiles) SetMetadata(md MBTilesMetadata) error {
+	if md.Format == "" {
+		md.Format = string(m.Format)
+		if m.Format == "" {
+			md.Format = string(PNG)
+		} else if m.Format == JPEG {
+			md.Format = "jpg"
+		}
+	}
+	values := map[string]string{
+		"name":    md.Name,
+		"format":  md.Format,
+		"minzoom": strconv.Itoa(md.MinZoom),
+		"maxzoom": strconv.Itoa(md.MaxZoom),
+	}
+	if md.Bounds != [4]float64{} {
+		b := md.Bounds
+		values["bounds"] = fmt.Sprintf("%g,%g,%g,%g", b[0], b[1], b[2], b[3])
+	}
+	if md.Attribution != "" {
+		values["attribution"] = md.Attribution
+	}
+	if md.Description != "" {
+		values["description"] = md.Description
+	}
+	for k, v := range md.Other {
+		if _, ok := values[k]; ok {
+			return errors.New("mbtiles: metadata " + k + " is not allowed in Other")
+		}
+		values[k] = v
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM metadata`); err != nil {
+		return err
+	}
+	for k, v := range values {
+		if _, err := tx.Exec(`INSERT INTO metadata (name, value) VALUES (?, ?)`, k, v); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// tmsRow converts between the tile y number and the TMS row.
+func tmsRow(z, y int) int {
+	return (1 << uint(z)) - 1 - y
+}
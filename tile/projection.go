@@ -0,0 +1,175 @@
+package tile
+
+import "math"
+
+// Projection transforms spherical coordinates to planar coordinates and back.
+// The planar x coordinate increases eastwards and y northwards.
+type Projection interface {
+	Project(d LatLon) (x, y float64)
+	Unproject(x, y float64) LatLon
+}
+
+// TileProjection is a Projection with a tile grid.
+// Tile 0/0/0 is a square with the top left corner at x0, y0 and the edge length extent in projected units.
+// The tiles at zoom level z have the edge length extent/2^z.
+type TileProjection interface {
+	Projection
+	TileGrid() (x0, y0, extent float64)
+}
+
+// ProjectWorld converts d to world coordinates of the tile grid of p.
+// The world coordinates are 0, 0 at the top left and 1, 1 at the bottom right corner of tile 0/0/0.
+// WebMercator uses the closed form of LatLon.World instead of the detour over meters.
+func ProjectWorld(p TileProjection, d LatLon) World {
+	if _, ok := p.(WebMercator); ok {
+		return d.World()
+	}
+	x, y := p.Project(d)
+	x0, y0, extent := p.TileGrid()
+	return World{(x - x0) / extent, (y0 - y) / extent}
+}
+
+// UnprojectWorld converts the world coordinates of the tile grid of p to spherical coordinates.
+func UnprojectWorld(p TileProjection, w World) LatLon {
+	if _, ok := p.(WebMercator); ok {
+		return w.LatLon()
+	}
+	x0, y0, extent := p.TileGrid()
+	return p.Unproject(x0+w.X*extent, y0-w.Y*extent)
+}
+
+// WebMercator is the spherical mercator projection used by web maps (EPSG:3857).
+// The projected coordinates are in meters on a sphere with the equatorial radius of WGS84.
+// Its tile grid is the one of XY.
+type WebMercator struct{}
+
+// Project returns the web mercator coordinates of d in meters.
+// The poles are projected to infinity.
+func (WebMercator) Project(d LatLon) (x, y float64) {
+	a := float64(WGS84.A)
+	return a * d.Lon.Radians(), a * math.Log(math.Tan(math.Pi/4+d.Lat.Radians()/2))
+}
+
+// Unproject returns the spherical coordinates of the web mercator coordinates in meters.
+func (WebMercator) Unproject(x, y float64) LatLon {
+	a := float64(WGS84.A)
+	return LatLon{degrees(math.Atan(math.Sinh(y / a))), degrees(x / a)}
+}
+
+// TileGrid returns the square from 180°W to 180°E and from MaxLatitude to -MaxLatitude.
+func (WebMercator) TileGrid() (x0, y0, extent float64) {
+	a := float64(WGS84.A)
+	return -math.Pi * a, math.Pi * a, 2 * math.Pi * a
+}
+
+// PlateCarree is the equirectangular projection (EPSG:4326).
+// The projected coordinates are the longitude and the latitude in degree.
+type PlateCarree struct{}
+
+// Project returns the longitude and latitude of d.
+func (PlateCarree) Project(d LatLon) (x, y float64) {
+	return float64(d.Lon), float64(d.Lat)
+}
+
+// Unproject returns the spherical coordinates for the longitude x and the latitude y.
+func (PlateCarree) Unproject(x, y float64) LatLon {
+	return LatLon{Degree(y), Degree(x)}
+}
+
+// TileGrid returns the square from 180°W to 0° and from 90°N to 90°S.
+// The world is covered by 2 tiles at zoom level 0,
+// as in the EPSG:4326 tile schemes of TMS and Leaflet.
+func (PlateCarree) TileGrid() (x0, y0, extent float64) {
+	return -180, 90, 180
+}
+
+// UTM is the Universal Transverse Mercator projection on the WGS84 ellipsoid
+// for the zone [1, 60] on the northern or southern hemisphere.
+// The projected coordinates are easting and northing in meters,
+// with the false easting of 500km and the false northing of 10000km on the southern hemisphere.
+// The transformation uses the Krüger series to the third order of the flattening,
+// which is accurate to about a millimeter within the zone.
+type UTM struct {
+	Zone  int
+	South bool
+}
+
+// UTMZone returns the UTM zone of d, including the exceptions for Norway and Svalbard.
+func UTMZone(d LatLon) UTM {
+	zone := int(math.Floor((float64(d.Lon)+180)/6)) + 1
+	zone = max(1, min(zone, 60))
+	switch {
+	case d.Lat >= 56 && d.Lat < 64 && d.Lon >= 3 && d.Lon < 12:
+		zone = 32
+	case d.Lat >= 72 && d.Lon >= 0 && d.Lon < 42:
+		zone = 31 + 2*int((float64(d.Lon)+3)/12)
+	}
+	return UTM{Zone: zone, South: d.Lat < 0}
+}
+
+const (
+	utmScale         = 0.9996
+	utmFalseEasting  = 500e3
+	utmFalseNorthing = 10000e3
+)
+
+// utmSeries returns the coefficients of the Krüger series for the ellipsoid e.
+func utmSeries(e Ellipsoid) (A float64, α, β, δ [3]float64) {
+	n := e.F / (2 - e.F)
+	n2, n3 := n*n, n*n*n
+	A = float64(e.A) / (1 + n) * (1 + n2/4 + n2*n2/64)
+	α = [3]float64{n/2 - 2*n2/3 + 5*n3/16, 13*n2/48 - 3*n3/5, 61 * n3 / 240}
+	β = [3]float64{n/2 - 2*n2/3 + 37*n3/96, n2/48 + n3/15, 17 * n3 / 480}
+	δ = [3]float64{2*n - 2*n2/3 - 2*n3, 7*n2/3 - 8*n3/5, 56 * n3 / 15}
+	return A, α, β, δ
+}
+
+// Project returns easting and northing of d.
+func (u UTM) Project(d LatLon) (x, y float64) {
+	A, α, _, _ := utmSeries(WGS84)
+	n := WGS84.F / (2 - WGS84.F)
+	e := 2 * math.Sqrt(n) / (1 + n)
+	sinφ := math.Sin(d.Lat.Radians())
+	t := math.Sinh(math.Atanh(sinφ) - e*math.Atanh(e*sinφ))
+	λ := (d.Lon - u.centralMeridian()).Radians()
+	ξ := math.Atan2(t, math.Cos(λ))
+	η := math.Atanh(math.Sin(λ) / math.Sqrt(1+t*t))
+	x, y = η, ξ
+	for j := range α {
+		k := 2 * float64(j+1)
+		x += α[j] * math.Cos(k*ξ) * math.Sinh(k*η)
+		y += α[j] * math.Sin(k*ξ) * math.Cosh(k*η)
+	}
+	return utmFalseEasting + utmScale*A*x, u.falseNorthing() + utmScale*A*y
+}
+
+// Unproject returns the spherical coordinates of easting x and northing y.
+func (u UTM) Unproject(x, y float64) LatLon {
+	A, _, β, δ := utmSeries(WGS84)
+	ξ := (y - u.falseNorthing()) / (utmScale * A)
+	η := (x - utmFalseEasting) / (utmScale * A)
+	ξp, ηp := ξ, η
+	for j := range β {
+		k := 2 * float64(j+1)
+		ξp -= β[j] * math.Sin(k*ξ) * math.Cosh(k*η)
+		ηp -= β[j] * math.Cos(k*ξ) * math.Sinh(k*η)
+	}
+	χ := math.Asin(math.Sin(ξp) / math.Cosh(ηp))
+	φ := χ
+	for j := range δ {
+		φ += δ[j] * math.Sin(2*float64(j+1)*χ)
+	}
+	λ := math.Atan2(math.Sinh(ηp), math.Cos(ξp))
+	return LatLon{degrees(φ), wrap180(u.centralMeridian() + degrees(λ))}
+}
+
+func (u UTM) centralMeridian() Degree {
+	return Degree(6*u.Zone - 183)
+}
+
+func (u UTM) falseNorthing() float64 {
+	if u.South {
+		return utmFalseNorthing
+	}
+	return 0
+}
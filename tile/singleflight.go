@@ -0,0 +1,90 @@
+package tile
+
+import (
+	"context"
+	"sync"
+)
+
+// SingleFlight is a Server, which coalesces concurrent requests for the same tile.
+// A request for a tile, which is already being fetched, waits for and shares the result.
+//
+// Wrap a CombinedServer to prevent duplicate downloads and concurrent writes of the same local file:
+//
+//	tileServer := NewSingleFlight(CombinedServer{...})
+type SingleFlight struct {
+	Server Server
+	mu     sync.Mutex
+	calls  map[[3]int]*flight
+}
+
+// flight is a request in progress.
+type flight struct {
+	done    chan struct{} // closed when t and err are set
+	t       Tile
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// NewSingleFlight returns a SingleFlight for the Server s.
+func NewSingleFlight(s Server) *SingleFlight {
+	return &SingleFlight{Server: s}
+}
+
+// Get returns the tile from the underlying server, or waits for a running request of the same tile.
+func (s *SingleFlight) Get(z, x, y int) (Tile, error) {
+	return s.GetContext(context.Background(), z, x, y)
+}
+
+// GetContext is Get with a context.
+// The shared request is only cancelled, if the contexts of all waiting callers are done.
+func (s *SingleFlight) GetContext(ctx context.Context, z, x, y int) (Tile, error) {
+	x, y = normalizeTile(z, x, y)
+	key := [3]int{z, x, y}
+
+	s.mu.Lock()
+	if s.calls == nil {
+		s.calls = make(map[[3]int]*flight)
+	}
+	f, ok := s.calls[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		s.calls[key] = f
+		go s.fetch(fctx, key, f)
+	}
+	f.waiters++
+	s.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.t, f.err
+	case <-ctx.Done():
+		s.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			if s.calls[key] == f {
+				delete(s.calls, key)
+			}
+		}
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *SingleFlight) fetch(ctx context.Context, key [3]int, f *flight) {
+	f.t, f.err = WithContext(s.Server).GetContext(ctx, key[0], key[1], key[2])
+	s.mu.Lock()
+	if s.calls[key] == f {
+		delete(s.calls, key)
+	}
+	s.mu.Unlock()
+	f.cancel()
+	close(f.done)
+}
+
+// TileSize returns the tile size of the underlying server.
+func (s *SingleFlight) TileSize() int {
+	return SizeOf(s.Server)
+}
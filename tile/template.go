@@ -0,0 +1,129 @@
+package tile
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// TemplateServer is a Server which requests tiles from URLs built from a template.
+// HttpServer is the special case of the template "base/{z}/{x}/{y}.png".
+//
+// The template may contain the placeholders:
+//
+//	{z}, {x}, {y}: tile coordinates
+//	{-y}: y coordinate counted from the bottom edge (TMS)
+//	{quadkey}: tile coordinates as a Bing maps quadkey
+//	{s}: subdomain, the Subdomains are used in turn
+//
+// Example:
+//
+//	NewTemplateServer("https://{s}.tile.example.com/{z}/{x}/{y}@2x.png?key=secret", "a", "b", "c")
+type TemplateServer struct {
+	Template   string
+	Subdomains []string
+	Client     *Client // If nil, the DefaultClient is used.
+	Size       int     // Tile size in pixels, e.g. 512 for @2x tiles. 0 means TileSize.
+	next       uint32  // round-robin index into Subdomains
+}
+
+// NewTemplateServer returns a TemplateServer for the URL template and optional subdomains.
+func NewTemplateServer(template string, subdomains ...string) *TemplateServer {
+	return &TemplateServer{
+		Template:   template,
+		Subdomains: subdomains,
+	}
+}
+
+// Get returns the tile from the URL given by the template.
+func (s *TemplateServer) Get(z, x, y int) (Tile, error) {
+	return s.GetContext(context.Background(), z, x, y)
+}
+
+// GetContext is Get with a context, which aborts the request when it is done.
+func (s *TemplateServer) GetContext(ctx context.Context, z, x, y int) (Tile, error) {
+	url, err := s.URL(z, x, y)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.client().GetTile(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return t, checkSize(t, s.TileSize())
+}
+
+// TileSize returns the tile size of s.
+func (s *TemplateServer) TileSize() int {
+	if s.Size == 0 {
+		return TileSize
+	}
+	return s.Size
+}
+
+// checkSize returns an error, if the remote tile t is not of the expected size.
+// Decode accepts any square image.
+func checkSize(t Tile, size int) error {
+	if t != nil && t.Bounds().Dx() != size {
+		return fmt.Errorf("tile size is %d instead of %d", t.Bounds().Dx(), size)
+	}
+	return nil
+}
+
+func (s *TemplateServer) client() *Client {
+	if s.Client == nil {
+		return DefaultClient
+	}
+	return s.Client
+}
+
+// URL expands the template for the given tile.
+func (s *TemplateServer) URL(z, x, y int) (string, error) {
+	x, y = normalizeTile(z, x, y)
+	sub := ""
+	if strings.Contains(s.Template, "{s}") {
+		if len(s.Subdomains) == 0 {
+			return "", fmt.Errorf("url template %s: {s} needs subdomains", s.Template)
+		}
+		n := atomic.AddUint32(&s.next, 1)
+		sub = s.Subdomains[int(n-1)%len(s.Subdomains)]
+	}
+	r := strings.NewReplacer(
+		"{z}", strconv.Itoa(z),
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa(y),
+		"{-y}", strconv.Itoa(NumTiles(z)-1-y),
+		"{quadkey}", Quadkey(z, x, y),
+		"{s}", sub,
+	)
+	u := r.Replace(s.Template)
+	if i := strings.IndexByte(u, '{'); i >= 0 {
+		if j := strings.IndexByte(u[i:], '}'); j > 0 {
+			return "", fmt.Errorf("url template %s: unknown placeholder %s", s.Template, u[i:i+j+1])
+		}
+	}
+	return u, nil
+}
+
+// Quadkey returns the tile coordinates as a string of base-4 digits, one for each zoom level.
+// The quadkey for zoom level 0 is empty.
+//
+// Reference:
+// https://docs.microsoft.com/en-us/bingmaps/articles/bing-maps-tile-system
+func Quadkey(z, x, y int) string {
+	b := make([]byte, z)
+	for i := z; i > 0; i-- {
+		mask := 1 << uint(i-1)
+		d := byte('0')
+		if x&mask != 0 {
+			d++
+		}
+		if y&mask != 0 {
+			d += 2
+		}
+		b[z-i] = d
+	}
+	return string(b)
+}
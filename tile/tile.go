@@ -1,6 +1,9 @@
 package tile
 
 import (
+	"bytes"
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"image"
@@ -9,16 +12,16 @@ import (
 	"image/png"
 	"io"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 )
 
-// Tile is a 256x256 part of a map as an image in web Mercator projection (EPSG:3857).
+// Tile is a square part of a map as an image in web Mercator projection (EPSG:3857).
+// It usually has TileSize (256x256) pixels, see Sizer for other sizes.
 //
 // Zoom levels: 0-24
 //	0: single tile of hole world
@@ -40,14 +43,42 @@ type Tile draw.Image
 //
 // Example:
 //	tileServer := CombinedServer{
-//		CacheServer: NewCacheServer(10000),
-//		LocalServer: "path/to/static/tiles",
-//		HttpServer: "http://a.tileserver.mymap.com",
+//		Cache: NewCacheServer(10000),
+//		Local: "path/to/static/tiles",
+//		Http:  "http://a.tileserver.mymap.com",
 //	}
 type Server interface {
 	Get(z, x, y int) (Tile, error)
 }
 
+// ContextServer is a Server whose requests can be cancelled or limited by a deadline.
+// GetContext returns ctx.Err(), if the context is done before the tile is available.
+type ContextServer interface {
+	Server
+	GetContext(ctx context.Context, z, x, y int) (Tile, error)
+}
+
+// WithContext returns s as a ContextServer.
+// If s does not implement it, the returned adapter checks the context before calling Get,
+// but it cannot interrupt a call that is already running.
+func WithContext(s Server) ContextServer {
+	if c, ok := s.(ContextServer); ok {
+		return c
+	}
+	return contextServer{s}
+}
+
+type contextServer struct {
+	Server
+}
+
+func (s contextServer) GetContext(ctx context.Context, z, x, y int) (Tile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Get(z, x, y)
+}
+
 // SparseServer may not contain all tiles.
 // Get returns the black tile, if it is not available.
 // Next iterates over all available tiles and returns a nil error, if the tile is valid.
@@ -58,127 +89,276 @@ type SparseServer interface {
 
 // HttpServer is a Server which requests tiles from a URL.
 // It's value is the server base URL, e.g: "http://a.tileserver.mymap.com".
+// Requests are sent by the DefaultClient.
 type HttpServer string
 
 // Get returns the tile from HttpServer/z/x/y.png
 func (s HttpServer) Get(z, x, y int) (Tile, error) {
-	x, y = normalizeTile(z, x, y)
+	return s.GetContext(context.Background(), z, x, y)
+}
 
-	u, err := url.Parse(string(s))
+// GetContext is Get with a context, which aborts the request when it is done.
+func (s HttpServer) GetContext(ctx context.Context, z, x, y int) (Tile, error) {
+	url, err := s.URL(z, x, y)
 	if err != nil {
 		return nil, err
 	}
-	u.Path = path.Join(u.Path, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".png")
-	url := u.String()
-
-	log.Print("GET ", url)
-	res, err := http.Get(url)
+	t, err := DefaultClient.GetTile(ctx, url)
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("tile server response is not ok:%d: %s", res.StatusCode, res.Status)
-	}
-	if tile, err := decodePngTile(res.Body); err != nil {
-		return nil, fmt.Errorf("tile server did not return a valid png: %s", err)
-	} else {
-		return tile, nil
+	return t, checkSize(t, TileSize)
+}
+
+// URL returns the address of the tile HttpServer/z/x/y.png.
+func (s HttpServer) URL(z, x, y int) (string, error) {
+	x, y = normalizeTile(z, x, y)
+
+	u, err := url.Parse(string(s))
+	if err != nil {
+		return "", err
 	}
+	u.Path = path.Join(u.Path, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".png")
+	return u.String(), nil
 }
 
 // LocalServer is the base directory for a static tile file system on disk.
+// It stores png files and is the same as FileServer{Dir: string(l)}.
 type LocalServer string
 
 // Get returns the tile from disk from the path LocalTile/z/x/y.png
 func (l LocalServer) Get(z, x, y int) (Tile, error) {
-	x, y = normalizeTile(z, x, y)
-	file := filepath.Join(string(l), strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".png")
-	if r, err := os.Open(file); err != nil {
-		return nil, err
-	} else {
-		defer r.Close()
-		return decodePngTile(r)
-	}
+	return l.files().Get(z, x, y)
+}
+
+// GetContext returns the tile from disk, if ctx is not done.
+func (l LocalServer) GetContext(ctx context.Context, z, x, y int) (Tile, error) {
+	return l.files().GetContext(ctx, z, x, y)
 }
 
 // Add writes the tile to disk.
 // It overwrites any existing file.
+// The tile is written to a temporary file first, which is renamed to z/x/y.png,
+// so readers never see a partially written tile.
 func (l LocalServer) Add(z, x, y int, t Tile) error {
-	x, y = normalizeTile(z, x, y)
-	if string(l) == "" {
-		return errors.New("the local tile server path is unset")
-	}
-	dir := filepath.Join(string(l), strconv.Itoa(z), strconv.Itoa(x))
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
-	}
-	file := filepath.Join(dir, strconv.Itoa(y)+".png")
-	if f, err := os.Create(file); err != nil {
-		return err
-	} else {
-		defer f.Close()
-		return png.Encode(f, t)
-	}
+	return l.files().Add(z, x, y, t)
 }
 
-// decodePngTile returns a Tile from a png read from r.
-func decodePngTile(r io.Reader) (Tile, error) {
-	if img, err := png.Decode(r); err != nil {
-		return nil, err
-	} else {
-		if img.Bounds().Dx() != 256 || img.Bounds().Dy() != 256 {
-			return nil, errors.New("png tile size is not 256x256")
-		}
-		return Tile(img.(draw.Image)), nil
+func (l LocalServer) getRaw(ctx context.Context, z, x, y int, v Validity) (Tile, []byte, Validity, error) {
+	return l.files().getRaw(ctx, z, x, y, v)
+}
+
+func (l LocalServer) files() FileServer {
+	return FileServer{Dir: string(l)}
+}
+
+// rawServer is implemented by the servers of this package, which return the encoded tile
+// as received from the source together with the decoded tile.
+// Remote servers send the validators of v with a conditional request, local servers ignore it.
+// CombinedServer uses it to store the original bytes in an encoded CacheServer.
+type rawServer interface {
+	getRaw(ctx context.Context, z, x, y int, v Validity) (Tile, []byte, Validity, error)
+}
+
+// getRaw returns the tile from s, and it's encoded bytes, if s is a rawServer.
+func getRaw(ctx context.Context, s Server, z, x, y int) (Tile, []byte, error) {
+	if r, ok := s.(rawServer); ok {
+		t, b, _, err := r.getRaw(ctx, z, x, y, Validity{})
+		return t, b, err
 	}
+	t, err := WithContext(s).GetContext(ctx, z, x, y)
+	return t, nil, err
+}
+
+// Store is a Server, which tiles can be added to.
+// It is implemented by LocalServer and FileServer.
+type Store interface {
+	Server
+	Add(z, x, y int, t Tile) error
 }
 
 // CacheServer is an in-memory Server.
-// Use NewCacheServer to create and enable a CacheServer.
+// Use NewCacheServer or NewEncodedCacheServer to create and enable a CacheServer.
+// If the cache is full, the least recently used tiles are evicted.
 type CacheServer struct {
-	maxTiles int // If this is non-zero, it does not store more tiles that this number.
-	m        map[[3]int]Tile
+	maxTiles int   // If this is non-zero, it does not store more tiles that this number.
+	maxBytes int64 // If this is non-zero, it limits the size of all tiles.
+	bytes    int64
+	encoded  bool // Tiles are stored encoded and decoded by Get.
+	m        map[[3]int]*list.Element
+	lru      list.List // Values are *cacheEntry, the most recently used tile is at the front.
+	stats    CacheStats
 	sync.Mutex
 }
 
+type cacheEntry struct {
+	key  [3]int
+	t    Tile
+	b    []byte // encoded tile, if the cache is encoded
+	size int64
+}
+
+// CacheStats reports the usage of a CacheServer.
+type CacheStats struct {
+	Tiles     int   // Number of cached tiles.
+	Bytes     int64 // Decoded image size of all cached tiles, or the encoded size for an encoded cache.
+	Hits      int64 // Number of successful calls to Get.
+	Misses    int64 // Number of calls to Get for tiles which are not cached.
+	Evictions int64 // Number of tiles removed to make room for new ones.
+}
+
 // Get returns a tile from the cache.
 func (c *CacheServer) Get(z, x, y int) (Tile, error) {
 	x, y = normalizeTile(z, x, y)
 	c.Lock()
-	defer c.Unlock()
-	if t, ok := c.m[[3]int{z, x, y}]; !ok {
+	e, ok := c.m[[3]int{z, x, y}]
+	if !ok {
+		c.stats.Misses++
+		c.Unlock()
 		return nil, errors.New("tile is not cached")
-	} else {
-		return t, nil
 	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	entry := e.Value.(*cacheEntry)
+	c.Unlock()
+	if c.encoded {
+		t, _, err := Decode(bytes.NewReader(entry.b))
+		return t, err
+	}
+	return entry.t, nil
+}
+
+// GetContext returns a tile from the cache, if ctx is not done.
+func (c *CacheServer) GetContext(ctx context.Context, z, x, y int) (Tile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Get(z, x, y)
 }
 
 // Add adds a tile to the cache.
 // It returns immediately, if the CacheServer is not enabled.
+// Least recently used tiles are evicted, if the cache exceeds it's limits.
+// An encoded cache stores the tile png encoded.
 func (c *CacheServer) Add(z, x, y int, t Tile) {
+	c.add(z, x, y, t, nil)
+}
+
+// add adds a tile to the cache.
+// An encoded cache stores raw, which are the encoded bytes of t from the source, if it is not nil.
+func (c *CacheServer) add(z, x, y int, t Tile, raw []byte) {
 	x, y = normalizeTile(z, x, y)
-	if c.m == nil {
+	if c.m == nil || c.maxTiles < 0 {
+		return
+	}
+	entry := cacheEntry{key: [3]int{z, x, y}}
+	if c.encoded && raw != nil {
+		entry.b = raw
+		entry.size = int64(len(raw))
+	} else if c.encoded {
+		var buf bytes.Buffer
+		if err := cacheEncoder.Encode(&buf, t); err != nil {
+			return
+		}
+		entry.b = buf.Bytes()
+		entry.size = int64(len(entry.b))
+	} else {
+		entry.t = t
+		entry.size = imageSize(t)
+	}
+	if c.maxBytes > 0 && entry.size > c.maxBytes {
 		return
 	}
 	c.Lock()
-	if c.maxTiles == 0 || len(c.m) < c.maxTiles {
-		c.m[[3]int{z, x, y}] = t
+	defer c.Unlock()
+	if e, ok := c.m[entry.key]; ok {
+		c.remove(e)
 	}
-	c.Unlock()
+	c.m[entry.key] = c.lru.PushFront(&entry)
+	c.bytes += entry.size
+	for (c.maxTiles > 0 && len(c.m) > c.maxTiles) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove deletes the list element e from the cache.
+// The lock must be held.
+func (c *CacheServer) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.m, entry.key)
+	c.bytes -= entry.size
+}
+
+// Stats returns the current usage and the access counters of the cache.
+func (c *CacheServer) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	s := c.stats
+	s.Tiles = len(c.m)
+	s.Bytes = c.bytes
+	return s
 }
 
 // NewCacheServer enables and returns a CacheServer.
-// Set maxTiles to 0 if there is no limit on the number of tiles to be cached.
+// Set maxTiles to 0 if there is no limit on the number of tiles to be cached,
+// or to a negative value to disable caching.
 func NewCacheServer(maxTiles int) *CacheServer {
+	return NewCacheServerBytes(maxTiles, 0)
+}
+
+// NewCacheServerBytes returns a CacheServer, which additionally limits the memory used by
+// the decoded images of all cached tiles to maxBytes.
+// A 256x256 RGBA tile uses 256KB.
+// Set maxBytes to 0 if there is no limit.
+func NewCacheServerBytes(maxTiles int, maxBytes int64) *CacheServer {
 	var c CacheServer
-	c.m = make(map[[3]int]Tile)
+	c.m = make(map[[3]int]*list.Element)
 	c.maxTiles = maxTiles
+	c.maxBytes = maxBytes
 	return &c
 }
 
+// NewEncodedCacheServer returns a CacheServer, which stores encoded tiles and decodes them
+// on each call to Get.
+// Tiles from the servers of this package added by CombinedServer keep the encoding of their source,
+// other tiles are png encoded.
+// It trades cpu time for memory: typical map tiles need 10-50KB instead of 256KB.
+// The size of all encoded tiles is limited to maxBytes, which must be positive.
+func NewEncodedCacheServer(maxBytes int64) *CacheServer {
+	if maxBytes <= 0 {
+		panic("encoded cache needs a memory budget")
+	}
+	c := NewCacheServerBytes(0, maxBytes)
+	c.encoded = true
+	return c
+}
+
+// cacheEncoder prefers speed over size, as tiles in memory are short-lived.
+var cacheEncoder = png.Encoder{CompressionLevel: png.BestSpeed}
+
+// imageSize returns the memory used by the pixels of the decoded image t.
+func imageSize(t Tile) int64 {
+	switch im := t.(type) {
+	case *image.RGBA:
+		return int64(len(im.Pix))
+	case *image.NRGBA:
+		return int64(len(im.Pix))
+	case *image.Paletted:
+		return int64(len(im.Pix))
+	case *image.Gray:
+		return int64(len(im.Pix))
+	case *image.Alpha:
+		return int64(len(im.Pix))
+	}
+	b := t.Bounds()
+	return int64(4 * b.Dx() * b.Dy())
+}
+
 // UniformServer returns tiles with a uniform color.
 type UniformServer struct {
 	Color color.Color
+	Size  int // Tile size in pixels, 0 means TileSize.
 	im    *image.RGBA
 }
 
@@ -186,12 +366,21 @@ type UniformServer struct {
 func (u *UniformServer) Get(z, x, y int) (Tile, error) {
 	x, y = normalizeTile(z, x, y)
 	if u.im == nil {
-		u.im = image.NewRGBA(image.Rect(0, 0, 256, 256))
+		n := u.TileSize()
+		u.im = image.NewRGBA(image.Rect(0, 0, n, n))
 		draw.Draw(u.im, u.im.Bounds(), &image.Uniform{u.Color}, image.ZP, draw.Src)
 	}
 	return Tile(u.im), nil
 }
 
+// TileSize returns the tile size of u.
+func (u *UniformServer) TileSize() int {
+	if u.Size == 0 {
+		return TileSize
+	}
+	return u.Size
+}
+
 // A PointServer renders coordinates as points on a transparent background.
 type PointServer struct {
 	Color  color.Color
@@ -222,7 +411,7 @@ func NewPointServer(file string, c color.Color) *PointServer {
 }
 
 func (p *PointServer) Get(z, x, y int) (Tile, error) {
-	im := image.NewAlpha(image.Rect(0, 0, 256, 256))
+	im := image.NewAlpha(image.Rect(0, 0, TileSize, TileSize))
 	for _, c := range p.coords {
 		if xy, err := c.XY(z); err != nil {
 			if xy.X == x && xy.Y == y {
@@ -274,7 +463,7 @@ func (s *SparsePointServer) Get(z, x, y int) (Tile, error) {
 	if z != s.z {
 		return nil, fmt.Errorf("SparsePointServer: Get called with zoom level %d, but only %d is available", z, s.z)
 	}
-	im := image.NewAlpha(image.Rect(0, 0, 256, 256))
+	im := image.NewAlpha(image.Rect(0, 0, TileSize, TileSize))
 	if points, ok := s.points[point{x, y}]; ok {
 		for _, pt := range points {
 			im.Set(pt.x, pt.y, color.Opaque)
@@ -297,21 +486,36 @@ type point struct {
 	x, y int
 }
 
-// CombinedServer combines an CachedServer a LocalServer and an HttpServer.
+// CombinedServer combines an CachedServer a local Store and a remote Server.
+// The simple case is a LocalServer and an HttpServer.
+// Any other Store, e.g. a FileServer or MBTiles, and any other remote Server, e.g. a TemplateServer,
+// are set as Store and Remote, which take precedence over Local and Http.
+// Concurrent requests for the same tile are not coalesced, unless it is wrapped by a SingleFlight.
 type CombinedServer struct {
 	Points *PointServer
 	Cache  *CacheServer
 	Local  LocalServer
 	Http   HttpServer
+	Store  Store  // If not nil, it is used instead of Local.
+	Remote Server // If not nil, it is used instead of Http.
 }
 
 // Get returns a tile from the cache, the local filesystem or the net in that order.
 // It skipps any mode if it is not configured.
 // Any tiles retrieved are also cached in the local and the cache tile server,
 // if these are configured.
+// If the remote server is a ConditionalServer and the local store a ValidityStore,
+// the validity of tiles written to the local store is recorded,
+// and expired local tiles are revalidated.
 // Get never returns an error, if no tiles are present, it returns a black tile instead.
 func (c CombinedServer) Get(z, x, y int) (Tile, error) {
-	t, err := c.get(z, x, y)
+	return c.GetContext(context.Background(), z, x, y)
+}
+
+// GetContext is Get with a context.
+// In contrast to Get, it returns ctx.Err(), if the context is done before the tile is retrieved.
+func (c CombinedServer) GetContext(ctx context.Context, z, x, y int) (Tile, error) {
+	t, err := c.get(ctx, z, x, y)
 	if err != nil {
 		return t, err
 	}
@@ -320,7 +524,7 @@ func (c CombinedServer) Get(z, x, y int) (Tile, error) {
 	}
 
 	for _, coords := range c.Points.coords {
-		if xy, err := coords.XY(z); err == nil {
+		if xy, err := coords.XYSize(z, t.Bounds().Dx()); err == nil {
 			if xy.X == x && xy.Y == y {
 				t.Set(xy.XP, xy.YP, c.Points.Color)
 			}
@@ -328,35 +532,128 @@ func (c CombinedServer) Get(z, x, y int) (Tile, error) {
 	}
 	return t, nil
 }
-func (c CombinedServer) get(z, x, y int) (Tile, error) {
+func (c CombinedServer) get(ctx context.Context, z, x, y int) (Tile, error) {
 	x, y = normalizeTile(z, x, y)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if c.Cache != nil && c.Cache.m != nil {
 		if t, err := c.Cache.Get(z, x, y); err == nil {
 			return t, nil
 		}
 	}
-	if c.Local != LocalServer("") {
-		if t, err := c.Local.Get(z, x, y); err == nil {
+	ls, rs := c.store(), c.remote()
+	local, remote := ls != nil, rs != nil
+	cs, conditional := rs.(ConditionalServer)
+	vs, validity := ls.(ValidityStore)
+	conditional = conditional && validity
+	if local {
+		if t, raw, err := getRaw(ctx, ls, z, x, y); err == nil {
+			if remote && conditional {
+				t, raw = c.revalidate(ctx, cs, vs, z, x, y, t, raw)
+			}
 			if c.Cache != nil && c.Cache.m != nil {
-				c.Cache.Add(z, x, y, t)
+				c.Cache.add(z, x, y, t, raw)
 			}
 			return t, nil
 		}
 	}
-	if c.Http != HttpServer("") {
-		if t, err := c.Http.Get(z, x, y); err == nil {
-			if c.Local != LocalServer("") {
-				c.Local.Add(z, x, y, t)
+	if remote {
+		var t Tile
+		var raw []byte
+		var v Validity
+		var err error
+		if conditional {
+			t, raw, v, err = getIfModified(ctx, cs, z, x, y, Validity{})
+		} else {
+			t, raw, err = getRaw(ctx, rs, z, x, y)
+		}
+		if err == nil {
+			if local {
+				if err := ls.Add(z, x, y, t); err != nil {
+					log.Print(err)
+				} else if conditional {
+					if err := vs.SetValidity(z, x, y, v); err != nil {
+						log.Print(err)
+					}
+				}
 			}
 			if c.Cache != nil && c.Cache.m != nil {
-				c.Cache.Add(z, x, y, t)
+				c.Cache.add(z, x, y, t, raw)
 			}
 			return t, nil
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
 		} else {
 			log.Print(err)
 		}
 	}
-	return black, nil
+	return blackTile(c.TileSize()), nil
+}
+
+// TileSize returns the tile size of the remote server.
+func (c CombinedServer) TileSize() int {
+	if rs := c.remote(); rs != nil {
+		return SizeOf(rs)
+	}
+	return TileSize
+}
+
+// store returns the local store or nil, if none is configured.
+func (c CombinedServer) store() Store {
+	if c.Store != nil {
+		return c.Store
+	} else if c.Local != "" {
+		return c.Local
+	}
+	return nil
+}
+
+// remote returns the remote server or nil, if none is configured.
+func (c CombinedServer) remote() Server {
+	if c.Remote != nil {
+		return c.Remote
+	} else if c.Http != "" {
+		return c.Http
+	}
+	return nil
+}
+
+// revalidate returns the local tile t, if it has not expired,
+// or the tile from the remote server, which is also written to the local server.
+// If the remote server cannot be reached, the expired tile is returned.
+// The encoded bytes raw are returned with the tile, see rawServer.
+func (c CombinedServer) revalidate(ctx context.Context, remote ConditionalServer, local ValidityStore, z, x, y int, t Tile, raw []byte) (Tile, []byte) {
+	v, err := local.Validity(z, x, y)
+	if err != nil || !v.Expired(time.Now()) {
+		return t, raw
+	}
+	nt, nraw, v, err := getIfModified(ctx, remote, z, x, y, v)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Print(err)
+		}
+		return t, raw
+	}
+	if nt != nil {
+		if err := local.Add(z, x, y, nt); err != nil {
+			log.Print(err)
+		}
+		t, raw = nt, nraw
+	}
+	if err := local.SetValidity(z, x, y, v); err != nil {
+		log.Print(err)
+	}
+	return t, raw
+}
+
+// getIfModified is s.GetIfModified, which also returns the encoded tile, if s is a rawServer.
+func getIfModified(ctx context.Context, s ConditionalServer, z, x, y int, v Validity) (Tile, []byte, Validity, error) {
+	if r, ok := s.(rawServer); ok {
+		return r.getRaw(ctx, z, x, y, v)
+	}
+	t, v, err := s.GetIfModified(ctx, z, x, y, v)
+	return t, nil, v, err
 }
 
 // NumTiles returns the number of tiles per direction for the given zoom value.
@@ -389,7 +686,19 @@ func normalizeTile(z, x, y int) (X, Y int) {
 var black Tile
 
 func init() {
-	im := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	black = newBlackTile(TileSize)
+}
+
+// blackTile returns a black tile of the given size.
+func blackTile(size int) Tile {
+	if size == TileSize {
+		return black
+	}
+	return newBlackTile(size)
+}
+
+func newBlackTile(size int) Tile {
+	im := image.NewRGBA(image.Rect(0, 0, size, size))
 	draw.Draw(im, im.Bounds(), &image.Uniform{color.Black}, image.ZP, draw.Src)
-	black = im
+	return im
 }
@@ -0,0 +1,574 @@
+package tile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/color"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestHttpServerContext(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := HttpServer(srv.URL).GetContext(ctx, 1, 0, 0); err == nil {
+		t.Fatal("expected an error from a stalled server")
+	}
+	if ctx.Err() == nil {
+		t.Fatal("request returned before the deadline")
+	}
+
+	c := CombinedServer{Http: HttpServer(srv.URL)}
+	if tile, err := c.GetContext(ctx, 1, 0, 0); err != context.DeadlineExceeded || tile != nil {
+		t.Fatalf("CombinedServer: expected DeadlineExceeded, got %v", err)
+	}
+	if _, err := WithContext(Mandelbrot{}).GetContext(ctx, 0, 0, 0); err != context.DeadlineExceeded {
+		t.Fatalf("adapter: expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestCacheServerLRU(t *testing.T) {
+	c := NewCacheServer(2)
+	u := &UniformServer{Color: color.White}
+	tile, _ := u.Get(0, 0, 0)
+	c.Add(2, 0, 0, tile)
+	c.Add(2, 1, 0, tile)
+	if _, err := c.Get(2, 0, 0); err != nil { // 2/0/0 is now the most recently used tile.
+		t.Fatal(err)
+	}
+	c.Add(2, 2, 0, tile)
+	if _, err := c.Get(2, 1, 0); err == nil {
+		t.Fatal("least recently used tile has not been evicted")
+	}
+	for _, x := range []int{0, 2} {
+		if _, err := c.Get(2, x, 0); err != nil {
+			t.Fatalf("2/%d/0: %s", x, err)
+		}
+	}
+	s := c.Stats()
+	if s.Tiles != 2 || s.Hits != 3 || s.Misses != 1 || s.Evictions != 1 || s.Bytes != 2*256*256*4 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	c = NewCacheServerBytes(0, 3*256*256*4)
+	for x := 0; x < 4; x++ {
+		c.Add(2, x, 0, tile)
+	}
+	if s := c.Stats(); s.Tiles != 3 || s.Evictions != 1 {
+		t.Fatalf("byte budget: unexpected stats: %+v", s)
+	}
+
+	c = NewCacheServer(-1)
+	c.Add(2, 0, 0, tile)
+	if _, err := c.Get(2, 0, 0); err == nil {
+		t.Fatal("disabled cache stores tiles")
+	}
+}
+
+func TestEncodedCacheServer(t *testing.T) {
+	var m Mandelbrot
+	c := NewEncodedCacheServer(1 << 20)
+	want, _ := m.Get(3, 2, 1)
+	c.Add(3, 2, 1, want)
+	got, err := c.Get(3, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := want.Bounds(); got.Bounds() != b {
+		t.Fatalf("bounds differ: %v != %v", got.Bounds(), b)
+	}
+	for _, p := range [][2]int{{0, 0}, {17, 200}, {255, 255}} {
+		r0, g0, b0, a0 := want.At(p[0], p[1]).RGBA()
+		r1, g1, b1, a1 := got.At(p[0], p[1]).RGBA()
+		if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+			t.Fatalf("pixel %v differs", p)
+		}
+	}
+	if s := c.Stats(); s.Tiles != 1 || s.Bytes <= 0 || s.Bytes >= 256*256*4 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	// Tiles from a FileServer keep their jpeg encoding instead of being re-encoded as png.
+	dir := t.TempDir()
+	f := FileServer{Dir: dir, Format: JPEG}
+	if err := f.Add(3, 2, 1, want); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "3", "2", "1.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = NewEncodedCacheServer(1 << 20)
+	if _, err := (CombinedServer{Cache: c, Store: f}).Get(3, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Tiles != 1 || s.Bytes != int64(len(b)) {
+		t.Fatalf("cache stores %d bytes instead of the %d bytes of the jpeg file", s.Bytes, len(b))
+	}
+	if _, err := c.Get(3, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateServer(t *testing.T) {
+	s := NewTemplateServer("https://{s}.tile.example.com/{z}/{x}/{y}@2x.png?key=k&tms={-y}&q={quadkey}", "a", "b")
+	testCases := []struct {
+		z, x, y int
+		url     string
+	}{
+		{3, 3, 5, "https://a.tile.example.com/3/3/5@2x.png?key=k&tms=2&q=213"},
+		{3, -1, 0, "https://b.tile.example.com/3/7/0@2x.png?key=k&tms=7&q=111"},
+		{0, 0, 0, "https://a.tile.example.com/0/0/0@2x.png?key=k&tms=0&q="},
+	}
+	for _, tc := range testCases {
+		if u, err := s.URL(tc.z, tc.x, tc.y); err != nil {
+			t.Fatal(err)
+		} else if u != tc.url {
+			t.Errorf("%d/%d/%d: got %s, expected %s", tc.z, tc.x, tc.y, u, tc.url)
+		}
+	}
+	if _, err := NewTemplateServer("http://{s}.example.com/{z}/{x}/{y}.png").URL(0, 0, 0); err == nil {
+		t.Error("expected an error for {s} without subdomains")
+	}
+	if _, err := NewTemplateServer("http://example.com/{zoom}/{x}/{y}.png").URL(0, 0, 0); err == nil {
+		t.Error("expected an error for an unknown placeholder")
+	}
+	if u, _ := HttpServer("http://example.com/tiles").URL(2, 1, 3); u != "http://example.com/tiles/2/1/3.png" {
+		t.Errorf("HttpServer: %s", u)
+	}
+
+	// Remote tiles must have the size of the server.
+	png := pngTile(t, 512)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	}))
+	defer srv.Close()
+	if _, err := HttpServer(srv.URL).Get(0, 0, 0); err == nil {
+		t.Error("HttpServer: expected an error for a 512 pixel tile")
+	}
+	ts := NewTemplateServer(srv.URL + "/{z}/{x}/{y}.png")
+	ts.Size = 512
+	if _, err := ts.Get(0, 0, 0); err != nil {
+		t.Errorf("TemplateServer: %s", err)
+	}
+
+	// A CombinedServer uses the tile size of the remote server.
+	if n := (CombinedServer{Local: "tiles", Http: "http://example.com"}).TileSize(); n != TileSize {
+		t.Errorf("HttpServer: tile size %d", n)
+	}
+	if n := (CombinedServer{Local: "tiles", Remote: ts}).TileSize(); n != 512 {
+		t.Errorf("TemplateServer: tile size %d", n)
+	}
+}
+
+// pngTile returns a white tile of the given size, encoded as it is served by a tile server.
+func pngTile(t *testing.T, size int) []byte {
+	var b bytes.Buffer
+	tile, _ := (&UniformServer{Color: color.White, Size: size}).Get(0, 0, 0)
+	if err := cacheEncoder.Encode(&b, tile); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestClient(t *testing.T) {
+	png := pngTile(t, TileSize)
+
+	var mu sync.Mutex
+	var requests, active, maxActive int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		fail := requests <= 2
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		if r.Header.Get("User-Agent") != "test-agent" || r.Header.Get("X-Key") != "secret" {
+			http.Error(w, "missing headers", http.StatusForbidden)
+			return
+		}
+		if fail {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write(png)
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		UserAgent: "test-agent",
+		Header:    http.Header{"X-Key": []string{"secret"}},
+		Timeout:   time.Second,
+		MaxConns:  2,
+		Rate:      100,
+		Retries:   2,
+		Backoff:   time.Millisecond,
+	}
+	s := NewTemplateServer(srv.URL + "/{z}/{x}/{y}.png")
+	s.Client = c
+
+	// The first tile succeeds after 2 retries.
+	if _, err := s.Get(1, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.Get(4, i, 0); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if maxActive > 2 {
+		t.Errorf("%d concurrent requests exceed MaxConns", maxActive)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("10 requests at 100/s took only %s", d)
+	}
+
+	// Client errors are not retried.
+	c.UserAgent = ""
+	requests = 0
+	if _, err := s.Get(1, 0, 0); err == nil {
+		t.Fatal("expected an error")
+	} else if se, ok := err.(StatusError); !ok || se.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a StatusError 403, got %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("403 has been retried")
+	}
+
+	// Invalid urls fail immediately.
+	c.Backoff = time.Hour
+	for _, u := range []string{"http://[::1/0/0/0.png", "ftp://example.com/0/0/0.png"} {
+		if _, err := c.GetTile(context.Background(), u); err == nil {
+			t.Fatalf("%s: expected an error", u)
+		}
+	}
+
+	// Network errors are retried.
+	c.Backoff = time.Millisecond
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	if _, err := c.GetTile(context.Background(), closed.URL+"/0/0/0.png"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := strings.Count(buf.String(), "retry in"); n != c.Retries {
+		t.Fatalf("expected %d retries, got %d:\n%s", c.Retries, n, buf.String())
+	}
+}
+
+func TestCombinedServerRevalidate(t *testing.T) {
+	png := pngTile(t, TileSize)
+	var full, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(png)
+	}))
+	defer srv.Close()
+
+	local := LocalServer(t.TempDir())
+	c := CombinedServer{Local: local, Http: HttpServer(srv.URL)}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get(2, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if full != 1 || notModified != 2 {
+		t.Fatalf("expected 1 full and 2 conditional requests, got %d and %d", full, notModified)
+	}
+	if v, err := local.Validity(2, 1, 1); err != nil {
+		t.Fatal(err)
+	} else if v.ETag != `"v1"` || v.Expires.IsZero() {
+		t.Fatalf("validity has not been recorded: %+v", v)
+	}
+}
+
+func TestValidityLifetime(t *testing.T) {
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	res := func(h ...string) *http.Response {
+		r := &http.Response{Header: make(http.Header)}
+		r.Header.Set("Date", date.Format(http.TimeFormat))
+		for i := 0; i < len(h); i += 2 {
+			r.Header.Set(h[i], h[i+1])
+		}
+		return r
+	}
+	v := Validity{}.update(res("ETag", `"v1"`, "Cache-Control", "max-age=3600"))
+	if v.Lifetime != time.Hour || !v.Expires.Equal(date.Add(time.Hour)) {
+		t.Fatalf("max-age: %+v", v)
+	}
+
+	// The lifetime survives the sidecar file.
+	local := LocalServer(t.TempDir())
+	if err := local.SetValidity(1, 0, 0, v); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := local.Validity(1, 0, 0); err != nil {
+		t.Fatal(err)
+	} else if w.Lifetime != v.Lifetime || !w.Expires.Equal(v.Expires) {
+		t.Fatalf("stored validity %+v differs from %+v", w, v)
+	}
+
+	// A 304 without freshness headers keeps the lifetime.
+	date = date.Add(2 * time.Hour)
+	v = v.update(res())
+	if v.ETag != `"v1"` || !v.Expires.Equal(date.Add(time.Hour)) {
+		t.Fatalf("not modified: %+v", v)
+	}
+
+	// Without any lifetime, the tile never expires.
+	if v := (Validity{}).update(res()); !v.Expires.IsZero() {
+		t.Fatalf("no freshness headers: %+v", v)
+	}
+
+	// The zero Validity removes the sidecar file.
+	if err := local.SetValidity(1, 0, 0, Validity{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(string(local), "1", "0", "0.http")); !os.IsNotExist(err) {
+		t.Fatalf("sidecar file has not been removed: %v", err)
+	}
+}
+
+func TestSingleFlight(t *testing.T) {
+	png := pngTile(t, TileSize)
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		w.Write(png)
+	}))
+	defer srv.Close()
+
+	s := NewSingleFlight(CombinedServer{Local: LocalServer(t.TempDir()), Http: HttpServer(srv.URL)})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Get(3, 1, 2); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if requests != 1 {
+		t.Fatalf("expected a single request, got %d", requests)
+	}
+
+	// A cancelled caller does not cancel the request for others.
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := s.GetContext(ctx, 3, 2, 2)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go cancel()
+	if _, err := s.Get(3, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestLocalServerVerify(t *testing.T) {
+	dir := t.TempDir()
+	l := LocalServer(dir)
+	u := &UniformServer{Color: color.White}
+	tile, _ := u.Get(0, 0, 0)
+	for y := 0; y < 3; y++ {
+		if err := l.Add(2, 1, y, tile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Truncate one tile and leave a temporary file behind.
+	file := filepath.Join(dir, "2", "1", "1.png")
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, b[:len(b)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "2", "1", ".2.png.123"+tmpSuffix), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if bad, err := l.Verify(false); err != nil {
+		t.Fatal(err)
+	} else if len(bad) != 2 {
+		t.Fatalf("expected 2 bad files, got %v", bad)
+	}
+	if bad, err := l.Verify(true); err != nil || len(bad) != 2 {
+		t.Fatalf("repair: %v %v", bad, err)
+	}
+	if bad, err := l.Verify(false); err != nil || len(bad) != 0 {
+		t.Fatalf("after repair: %v %v", bad, err)
+	}
+	if _, err := l.Get(2, 1, 1); !os.IsNotExist(err) {
+		t.Fatalf("bad tile has not been removed: %v", err)
+	}
+	if _, err := l.Get(2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileServerJPEG(t *testing.T) {
+	dir := t.TempDir()
+	f := FileServer{Dir: dir, Format: JPEG, Quality: 90}
+	u := &UniformServer{Color: color.RGBA{0, 0, 255, 255}, Size: 512}
+	tile, _ := u.Get(0, 0, 0)
+	if err := f.Add(3, 2, 1, tile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "3", "2", "1.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := f.Get(3, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := got.Bounds().Dx(); n != 512 {
+		t.Fatalf("tile size: %d", n)
+	}
+	if r, g, b, _ := got.At(100, 100).RGBA(); r>>8 > 8 || g>>8 > 8 || b>>8 < 247 {
+		t.Fatalf("unexpected color %v", got.At(100, 100))
+	}
+	got.Set(0, 0, color.White) // decoded jpeg tiles must be drawable
+
+	// The format is detected by content, independent of the extension.
+	var buf bytes.Buffer
+	if err := JPEG.Encode(&buf, tile, 0); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+	if _, err := (&Client{}).GetTile(context.Background(), srv.URL+"/0/0/0.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WebP.Encode(&buf, tile, 0); err == nil {
+		t.Fatal("expected webp encoding error")
+	}
+}
+
+func TestMBTiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mbtiles")
+	m, err := OpenMBTiles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &UniformServer{Color: color.RGBA{255, 0, 0, 255}}
+	tile, _ := u.Get(0, 0, 0)
+	if err := m.Add(2, 1, 0, tile); err != nil {
+		t.Fatal(err)
+	}
+	md := MBTilesMetadata{Name: "test", Bounds: [4]float64{-180, -85, 180, 85}, MaxZoom: 2, Other: map[string]string{"type": "baselayer"}}
+	if err := m.SetMetadata(md); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(2, 1, 1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected not exist: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = OpenMBTiles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	var row int
+	if err := m.db.QueryRow(`SELECT tile_row FROM tiles WHERE zoom_level=2 AND tile_column=1`).Scan(&row); err != nil || row != 3 {
+		t.Fatalf("tms row: %d %v", row, err)
+	}
+	if got, err := m.Get(2, 1, 0); err != nil {
+		t.Fatal(err)
+	} else if got.At(5, 5) != tile.At(5, 5) {
+		t.Fatalf("got %v", got.At(5, 5))
+	}
+
+	// A missing source file is not created.
+	missing := filepath.Join(t.TempDir(), "missing.mbtiles")
+	if _, err := OpenMBTilesReadOnly(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected not exist: %v", err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatal("missing file has been created")
+	}
+	ro, err := OpenMBTilesReadOnly(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if got, err := ro.Get(2, 1, 0); err != nil || got.At(5, 5) != tile.At(5, 5) {
+		t.Fatalf("read-only: %v", err)
+	}
+	if err := ro.Add(2, 2, 0, tile); err == nil {
+		t.Fatal("expected an error adding to a read-only file")
+	}
+	got, err := m.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Format = "png"
+	if got.Name != md.Name || got.Format != md.Format || got.Bounds != md.Bounds || got.MaxZoom != 2 || got.Other["type"] != "baselayer" {
+		t.Fatalf("metadata: %+v", got)
+	}
+}
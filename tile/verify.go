@@ -0,0 +1,101 @@
+package tile
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tmpSuffix marks temporary files, which are written by writeFileAtomic.
+const tmpSuffix = ".tmp"
+
+// writeFileAtomic creates file with the content written by write.
+// The data is written to a temporary file in the same directory, which replaces file on success.
+// The temporary file is synced before the rename, so that file is not empty or truncated after a crash.
+func writeFileAtomic(file string, write func(io.Writer) error) error {
+	dir, name := filepath.Split(file)
+	f, err := os.CreateTemp(dir, "."+name+".*"+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Verify scans all tiles below the directory l and returns an error for each tile,
+// that cannot be decoded, and for each temporary file left over by an interrupted Add.
+// The errors are of type *os.PathError.
+// If repair is true, these files are removed, including the validity information of bad tiles.
+// The returned error is not nil, if the directory cannot be scanned or a file cannot be removed.
+func (l LocalServer) Verify(repair bool) (bad []error, err error) {
+	return l.files().Verify(repair)
+}
+
+// Verify checks all tiles with the extension of f, see LocalServer.Verify.
+func (f FileServer) Verify(repair bool) (bad []error, err error) {
+	ext := f.ext()
+	err = filepath.Walk(f.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		var e error
+		if strings.HasPrefix(name, ".") && strings.HasSuffix(name, tmpSuffix) {
+			e = &os.PathError{Op: "verify", Path: path, Err: os.ErrExist}
+		} else if strings.HasSuffix(name, ext) {
+			if e = verifyTile(path); e != nil {
+				e = &os.PathError{Op: "decode", Path: path, Err: e}
+			}
+		}
+		if e == nil {
+			return nil
+		}
+		bad = append(bad, e)
+		if repair {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			if err := os.Remove(strings.TrimSuffix(path, ext) + ".http"); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	return bad, err
+}
+
+func verifyTile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = Decode(f)
+	return err
+}
@@ -0,0 +1,122 @@
+package tile
+
+import "math"
+
+// World is a point in continuous web mercator coordinates (EPSG:3857) scaled to the unit square.
+// The origin is the top left corner of tile 0/0/0 at 180°W and MaxLatitude.
+// X increases eastwards and Y southwards, both are 1 at the bottom right corner of the tile.
+// In contrast to XY, it is not truncated to tiles and pixels.
+// Other projections are mapped to world coordinates by ProjectWorld.
+type World struct {
+	X, Y float64
+}
+
+// World converts d to world coordinates.
+// Latitudes beyond MaxLatitude result in Y values outside of [0, 1].
+// It is the closed form of ProjectWorld(WebMercator{}, d), which does not round
+// longitudes on tile boundaries into the previous tile.
+func (d LatLon) World() World {
+	lat := d.Lat.Radians()
+	return World{
+		X: (float64(d.Lon) + 180) / 360,
+		Y: (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2,
+	}
+}
+
+// LatLon converts w back to spherical coordinates.
+func (w World) LatLon() LatLon {
+	return LatLon{
+		Lat: degrees(math.Atan(math.Sinh(math.Pi * (1 - 2*w.Y)))),
+		Lon: Degree(360*w.X - 180),
+	}
+}
+
+// Pixel returns the global pixel coordinates of w at zoom level z for tiles of size x size pixels.
+func (w World) Pixel(z, size int) (x, y float64) {
+	s := float64(size) * math.Exp2(float64(z))
+	return w.X * s, w.Y * s
+}
+
+// PixelWorld returns the world coordinates of the global pixel coordinates x, y
+// at zoom level z for tiles of size x size pixels.
+func PixelWorld(z, size int, x, y float64) World {
+	s := float64(size) * math.Exp2(float64(z))
+	return World{x / s, y / s}
+}
+
+// XY truncates w to tile and pixel indexes for the zoom level and tiles of size x size pixels.
+// Positions within a ten-thousandth of a pixel of a pixel edge are moved to the edge,
+// so that the corners returned by XY.LatLon are truncated to the same pixel,
+// despite the rounding errors of the mercator latitude.
+func (w World) XY(z, size int) XY {
+	s := two[z] * float64(size)
+	x, y := int(snapPixel(w.X*s)), int(snapPixel(w.Y*s))
+	return XY{
+		X:    x / size,
+		Y:    y / size,
+		Z:    z,
+		XP:   x % size,
+		YP:   y % size,
+		Size: size,
+	}
+}
+
+// snapPixel rounds p to the nearest pixel edge, if it is closer than a ten-thousandth of a pixel.
+func snapPixel(p float64) float64 {
+	if r := math.Round(p); math.Abs(p-r) < 1e-4 {
+		return r
+	}
+	return p
+}
+
+// World returns the world coordinates of the top left corner of the pixel xy.
+func (xy XY) World() World {
+	x := float64(xy.X) + float64(xy.XP)/float64(xy.size())
+	y := float64(xy.Y) + float64(xy.YP)/float64(xy.size())
+	return World{x / two[xy.Z], y / two[xy.Z]}
+}
+
+// World32 is a point in fixed-point world coordinates.
+// The unit square of World is mapped to the full range of uint32.
+// The resolution is 2^-32 of the equator, which is less than 1cm.
+type World32 struct {
+	X, Y uint32
+}
+
+// Fixed converts w to fixed-point world coordinates by truncation.
+// X wraps around the antimeridian and Y is limited to the world square.
+func (w World) Fixed() World32 {
+	const s = 1 << 32
+	x := s * (w.X - math.Floor(w.X))
+	y := math.Max(0, math.Min(s*w.Y, math.MaxUint32))
+	return World32{uint32(math.Min(x, math.MaxUint32)), uint32(y)}
+}
+
+// World32 converts d to fixed-point world coordinates.
+func (d LatLon) World32() World32 {
+	return d.World().Fixed()
+}
+
+// World returns the center of the fixed-point cell w.
+// Converting it back with Fixed returns w.
+func (w World32) World() World {
+	const s = 1 << 32
+	return World{(float64(w.X) + 0.5) / s, (float64(w.Y) + 0.5) / s}
+}
+
+// LatLon converts w to spherical coordinates at the center of the fixed-point cell.
+func (w World32) LatLon() LatLon {
+	return w.World().LatLon()
+}
+
+// Pixel returns the global pixel coordinates of w at zoom level [0, 24] for tiles of TileSize pixels.
+func (w World32) Pixel(z int) (x, y uint32) {
+	checkZoom(z)
+	return w.X >> (24 - z), w.Y >> (24 - z)
+}
+
+// Tile returns the tile numbers of w at zoom level [0, 24].
+func (w World32) Tile(z int) (x, y int) {
+	checkZoom(z)
+	return int(uint64(w.X) >> (32 - z)), int(uint64(w.Y) >> (32 - z))
+}